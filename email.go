@@ -1,7 +1,6 @@
 package email
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
@@ -16,9 +15,11 @@ import (
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -30,28 +31,58 @@ const (
 
 // Attachment is a struct representing an email attachment.
 // Based on the mime/multipart.FileHeader struct, Attachment contains the name, MIMEHeader, and content of the attachment in question.
+//
+// Inline attachments are placed alongside the HTML body inside a
+// multipart/related entity, so that the HTML may reference them by Content-ID.
+//
+// If Open is set, content is instead read from the io.ReadCloser it returns,
+// each time the attachment is written (see AttachLazy).
 type Attachment struct {
 	Filename string
 	Header   textproto.MIMEHeader
 	Content  []byte
+	Inline   bool
+	Open     func() (io.ReadCloser, error)
+}
+
+// ContentID returns the attachment's Content-ID, without angle brackets, as
+// referenced by a `cid:` URL.
+func (at *Attachment) ContentID() string {
+	return trimContentID(at.Header.Get("Content-ID"))
 }
 
-// TODO: support multiple bodies in Email struct
+// Body is an alternative rendition of a message's content, such as
+// text/watch-html or text/x-amp-html.  Content must be UTF-8.
+type Body struct {
+	ContentType string // media type, with any parameters other than charset
+	Content     []byte
+}
 
 // Email defines an SMTP message.
+//
+// Text, HTML, Calendar and Alternatives are all alternative bodies: when there
+// are several, they are written to a multipart/alternative entity, ordered
+// from least to most preferred (see alternativeRank).
 type Email struct {
-	ReplyTo     []string
-	From        string
-	To          []string
-	Bcc         []string
-	Cc          []string
-	Subject     string
-	Text        []byte // Plaintext message (optional)
-	HTML        []byte // Html message (optional)
-	Sender      string // override From as SMTP envelope sender (optional)
-	Headers     textproto.MIMEHeader
-	Attachments []*Attachment
-	ReadReceipt []string
+	ReplyTo      []string
+	From         string
+	To           []string
+	Bcc          []string
+	Cc           []string
+	Subject      string
+	Text         []byte // Plaintext message (optional)
+	HTML         []byte // Html message (optional)
+	AutoText     bool   // when Text is empty, send HTMLToText(HTML) as the plaintext alternative
+	Calendar     []byte // iCalendar invitation, reply, etc. (optional); see Event
+	Alternatives []Body // other alternative bodies (optional)
+	Sender       string // override From as SMTP envelope sender (optional)
+	Headers      textproto.MIMEHeader
+	Attachments  []*Attachment
+	ReadReceipt  []string
+	SMIME        *SMIME   // sign and/or encrypt the message with S/MIME (optional)
+	OpenPGP      *OpenPGP // sign and/or encrypt the message with OpenPGP/MIME (optional)
+	DSN          *DSN     // request delivery status notifications, where the server offers them (optional)
+	Charset      string   // set by NewEmailFromReader to a charset it could not convert a body from; not used when sending
 }
 
 // NewEmail creates and initializes a new message struct.
@@ -62,19 +93,24 @@ func NewEmail() *Email {
 // A custom io.Reader that will trim any leading
 // whitespace, as this can cause email imports to fail.
 type trimReader struct {
-	rd io.Reader
+	rd      io.Reader
+	trimmed bool // leading whitespace is behind us
 }
 
-// Trims off any unicode whitespace from the originating reader.
-func (tr trimReader) Read(buf []byte) (int, error) {
+// Trims off any unicode whitespace from the start of the originating reader.
+func (tr *trimReader) Read(buf []byte) (int, error) {
 	n, err := tr.rd.Read(buf)
+	if tr.trimmed {
+		return n, err
+	}
 	t := bytes.TrimLeftFunc(buf[:n], unicode.IsSpace)
+	tr.trimmed = len(t) > 0
 	n = copy(buf, t)
 	return n, err
 }
 
 func decodeHdr(val string) string {
-	var wd mime.WordDecoder
+	wd := mime.WordDecoder{CharsetReader: charsetReader}
 	vdec, err := wd.DecodeHeader(val)
 	if err == nil {
 		return vdec
@@ -86,13 +122,26 @@ func decodeHdr(val string) string {
 NewEmailFromReader reads a stream of bytes from an io.Reader, and returns an
 email struct containing the parsed data.
 This function expects the data in RFC 5322 format.
+
+Any part that is not a text/plain, text/html or text/calendar body (or is one,
+but is marked as an attachment) is decoded into Email.Attachments, along with
+its original MIMEHeader, except for other text/* bodies found within a
+multipart/alternative entity, which are decoded into Email.Alternatives.
+
+Text, HTML and Calendar bodies are converted to UTF-8 from the charset named in
+their Content-Type (see RegisterCharset).  Bodies in charsets without a
+registered CharsetDecoder are left undecoded, and the first such charset is
+recorded in Email.Charset.
 */
 func NewEmailFromReader(r io.Reader) (*Email, error) {
+	return DefaultParseOptions.NewEmailFromReader(r)
+}
+
+// NewEmailFromReader is NewEmailFromReader, bounded by `opt`.
+func (opt ParseOptions) NewEmailFromReader(r io.Reader) (*Email, error) {
 	e := NewEmail()
-	s := trimReader{rd: r}
-	tp := textproto.NewReader(bufio.NewReader(s))
 	// Parse the main headers
-	hdrs, err := tp.ReadMIMEHeader()
+	hdrs, body, err := opt.readHeader(r)
 	if err != nil {
 		return e, err
 	}
@@ -133,144 +182,339 @@ func NewEmailFromReader(r io.Reader) (*Email, error) {
 		}
 	}
 	e.Headers = hdrs
-	body := tp.R
-	// Recursively parse the MIME parts
-	ps, err := ParseMIMEParts(body, e.Headers)
+	// Recursively parse the MIME parts, noting which are alternatives
+	pRoot, err := opt.ParseMIMETree(body, e.Headers)
 	if err != nil {
 		return e, err
 	}
+	var ps []*MIMENode
+	isAlternative := map[*MIMENode]bool{}
+	pRoot.Walk(func(pNode *MIMENode, _ int) error {
+		ct, _ := pNode.MediaType()
+		for _, pChild := range pNode.Children {
+			isAlternative[pChild] = (ct == "multipart/alternative")
+		}
+		if !pNode.IsMultipart() {
+			ps = append(ps, pNode)
+		}
+		return nil
+	})
 	for _, p := range ps {
 		if ct := p.Header.Get("Content-Type"); ct == "" {
 			return e, ErrMissingContentType
 		}
-		ct, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		ct, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
 		if err != nil {
 			return e, err
 		}
+		bAttached := isAttachmentPart(p.Header)
 		switch {
-		case ct == "text/plain":
-			e.Text = p.Body.Bytes()
-		case ct == "text/html":
-			e.HTML = p.Body.Bytes()
+		case ct == "text/plain" && !bAttached:
+			e.Text = e.decodeBody(params["charset"], p.Body)
+		case ct == "text/html" && !bAttached:
+			e.HTML = e.decodeBody(params["charset"], p.Body)
+		case ct == "text/calendar" && !bAttached:
+			e.Calendar = e.decodeBody(params["charset"], p.Body)
+		case strings.HasPrefix(ct, "text/") && isAlternative[p] && !bAttached:
+			charset := params["charset"]
+			delete(params, "charset")
+			e.Alternatives = append(e.Alternatives, Body{
+				ContentType: mime.FormatMediaType(ct, params),
+				Content:     e.decodeBody(charset, p.Body),
+			})
+		default:
+			// everything else, including inline parts, is kept as an attachment
+			disp, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+			e.Attachments = append(e.Attachments, &Attachment{
+				Filename: partFilename(p.Header),
+				Header:   p.Header,
+				Content:  p.Body,
+				Inline:   disp == "inline",
+			})
 		}
 	}
 	return e, nil
 }
 
+// decodeBody converts a text body to UTF-8 from its declared charset.  Bodies
+// in unsupported charsets are returned as-is, and the charset noted in
+// e.Charset.
+func (e *Email) decodeBody(charset string, body []byte) []byte {
+	dec, err := DecodeCharset(charset, body)
+	if err != nil {
+		if e.Charset == "" {
+			e.Charset = charset
+		}
+		return body
+	}
+	return dec
+}
+
+// partFilename returns the filename of a MIME part, taken from the `filename`
+// parameter of its Content-Disposition, or else the `name` parameter of its
+// Content-Type.
+func partFilename(mHdr textproto.MIMEHeader) string {
+	if _, params, err := mime.ParseMediaType(mHdr.Get("Content-Disposition")); err == nil {
+		if fn := params["filename"]; len(fn) > 0 {
+			return decodeHdr(fn)
+		}
+	}
+	if _, params, err := mime.ParseMediaType(mHdr.Get("Content-Type")); err == nil {
+		if fn := params["name"]; len(fn) > 0 {
+			return decodeHdr(fn)
+		}
+	}
+	return ""
+}
+
+// isAttachmentPart reports whether a MIME part should be kept as an Attachment
+// rather than as a message body: i.e. it is marked `attachment` in its
+// Content-Disposition, or it carries a filename.
+func isAttachmentPart(mHdr textproto.MIMEHeader) bool {
+	if disp, _, err := mime.ParseMediaType(mHdr.Get("Content-Disposition")); err == nil {
+		if disp == "attachment" {
+			return true
+		}
+	}
+	return len(partFilename(mHdr)) > 0
+}
+
 // Part is a copyable representation of a multipart.Part
 type Part struct {
 	Header textproto.MIMEHeader
 	Body   bytes.Buffer
 }
 
-func decodePart(iRdr io.Reader, mHdr textproto.MIMEHeader) (Part, error) {
-	if mHdr.Get("Content-Transfer-Encoding") == "base64" {
-		iRdr = base64.NewDecoder(base64.StdEncoding, iRdr)
-	}
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, iRdr); err != nil {
-		return Part{}, err
+// decodeTransfer wraps iRdr with a decoder for the given RFC 2045
+// Content-Transfer-Encoding.  7bit, 8bit, binary, and unrecognized encodings
+// are passed through as-is.
+func decodeTransfer(iRdr io.Reader, cte string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, iRdr)
+	case "quoted-printable":
+		return quotedprintable.NewReader(iRdr)
 	}
-	return Part{Body: buf, Header: mHdr}, nil
+	return iRdr
 }
 
 /*
 ParseMIMEParts will recursively walk a MIME entity and return a []mime.Part
-containing each (flattened) mime.Part found.
+containing each (flattened) mime.Part found.  Part bodies are decoded
+according to their Content-Transfer-Encoding (base64, quoted-printable, 7bit,
+8bit, or binary).  Use ParseMIMETree to keep the nesting of multipart entities.
 
-It is important to note that there are no limits to the number of recursions,
-so be careful when parsing unknown MIME structures!
+Parsing is bounded by DefaultParseOptions.  Use ParseOptions.ParseMIMEParts
+for tighter limits when parsing untrusted MIME structures.
 */
-// TODO: cap recursions
 func ParseMIMEParts(iRdr io.Reader, mHdr textproto.MIMEHeader) ([]Part, error) {
+	return DefaultParseOptions.ParseMIMEParts(iRdr, mHdr)
+}
 
-	// If no content type is given, set it to the default
-	if _, ok := mHdr["Content-Type"]; !ok {
-		mHdr.Set("Content-Type", defaultContentType)
-	}
+// ParseMIMEParts is ParseMIMEParts, bounded by `opt`.
+func (opt ParseOptions) ParseMIMEParts(iRdr io.Reader, mHdr textproto.MIMEHeader) ([]Part, error) {
 
-	ct, params, err := mime.ParseMediaType(mHdr.Get("Content-Type"))
-	if err != nil {
+	pRoot, err := opt.ParseMIMETree(iRdr, mHdr)
+	if pRoot == nil {
 		return nil, err
 	}
 
-	// If it's a multipart email, recursively parse the parts
 	var ps []Part
-	if strings.HasPrefix(ct, "multipart/") {
-
-		if _, ok := params["boundary"]; !ok {
-			return ps, ErrMissingBoundary
+	pRoot.Walk(func(pNode *MIMENode, _ int) error {
+		if !pNode.IsMultipart() {
+			ps = append(ps, Part{Header: pNode.Header, Body: *bytes.NewBuffer(pNode.Body)})
 		}
-		mr := multipart.NewReader(iRdr, params["boundary"])
-
-		for {
-			pPart, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return ps, err
-			}
-			if _, ok := pPart.Header["Content-Type"]; !ok {
-				pPart.Header.Set("Content-Type", defaultContentType)
-			}
-			subct, _, err := mime.ParseMediaType(pPart.Header.Get("Content-Type"))
-			if err != nil {
-				return ps, err
-			}
-
-			if strings.HasPrefix(subct, "multipart/") {
-
-				sps, err := ParseMIMEParts(pPart, pPart.Header)
-				if err != nil {
-					return ps, err
-				}
-				ps = append(ps, sps...)
-
-			} else {
-
-				part, eP := decodePart(pPart, pPart.Header)
-				if eP != nil {
-					return ps, eP
-				}
-				ps = append(ps, part)
-			}
-		}
-
-	} else {
-
-		part, eP := decodePart(iRdr, mHdr)
-		if eP != nil {
-			return ps, eP
-		}
-		ps = append(ps, part)
-	}
-
-	return ps, nil
+		return nil
+	})
+	return ps, err
 }
 
 // Attach attaches content from an io.Reader to the email.
 // The function will return the created Attachment for reference.
 func (e *Email) Attach(r io.Reader, filename string, contentType string) (*Attachment, error) {
+	return e.attach(r, filename, contentType, false)
+}
+
+func (e *Email) attach(r io.Reader, filename string, contentType string, bInline bool) (*Attachment, error) {
 	var buffer bytes.Buffer
 	if _, err := io.Copy(&buffer, r); err != nil {
 		return nil, err
 	}
+	at := newAttachment(filename, contentType, bInline)
+	at.Content = buffer.Bytes()
+	e.Attachments = append(e.Attachments, at)
+	return at, nil
+}
+
+/*
+AttachLazy attaches content to the email that is only read while the message
+is being written.  `open` is called each time the message is rendered (once
+per Send), and the io.ReadCloser it returns is closed afterwards.
+The function will return the created Attachment for reference.
+*/
+func (e *Email) AttachLazy(open func() (io.ReadCloser, error), filename string, contentType string) *Attachment {
+	at := newAttachment(filename, contentType, false)
+	at.Open = open
+	e.Attachments = append(e.Attachments, at)
+	return at
+}
+
+// newAttachment creates an Attachment's headers.  Inline parts always get a
+// generated (unique) Content-ID; others are identified by filename, if it can
+// be written as-is.
+func newAttachment(filename string, contentType string, bInline bool) *Attachment {
 	at := &Attachment{
 		Filename: filename,
 		Header:   textproto.MIMEHeader{},
-		Content:  buffer.Bytes(),
+		Inline:   bInline,
 	}
 	if contentType != "" {
 		at.Header.Set("Content-Type", contentType)
 	} else {
 		at.Header.Set("Content-Type", "application/octet-stream")
 	}
-	at.Header.Set("Content-Disposition", fmt.Sprintf("attachment;\r\n filename=\"%s\"", filename))
-	at.Header.Set("Content-ID", fmt.Sprintf("<%s>", filename))
+	if bInline {
+		at.Header.Set("Content-Disposition", dispositionHeader("inline", filename))
+	} else {
+		at.Header.Set("Content-Disposition", dispositionHeader("attachment", filename))
+	}
+	if isDotAtom(filename) && !bInline {
+		at.Header.Set("Content-ID", fmt.Sprintf("<%s>", filename))
+	} else if id, err := generateMessageID(); err == nil {
+		at.Header.Set("Content-ID", id)
+	}
 	at.Header.Set("Content-Transfer-Encoding", "base64")
-	e.Attachments = append(e.Attachments, at)
-	return at, nil
+	return at
+}
+
+// isDotAtom reports whether `s` is an RFC 5322 dot-atom of ASCII atext, and so
+// may be written in a header field as-is.
+func isDotAtom(s string) bool {
+	if (len(s) == 0) || (s[0] == '.') || (s[len(s)-1] == '.') || strings.Contains(s, "..") {
+		return false
+	}
+	for ix := 0; ix < len(s); ix++ {
+		c := s[ix]
+		if !isASCIILetter(c) && ((c < '0') || (c > '9')) && !strings.ContainsRune("!#$%&'*+-/=?^_`{|}~.", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+AttachInline attaches content from an io.Reader to the email as an inline part,
+such as an image displayed by the HTML body.  The part is given a unique
+Content-ID (RFC 2392), so the HTML body may reference it as
+"cid:"+at.ContentID(), even when several parts share a filename.
+The function will return the created Attachment for reference.
+*/
+func (e *Email) AttachInline(r io.Reader, filename string, contentType string) (*Attachment, error) {
+	return e.attach(r, filename, contentType, true)
+}
+
+// Filename parameter sizes that keep Content-Disposition lines within 78 columns.
+const (
+	maxQuotedFilename = 60 // longest filename written as a plain quoted-string
+	max2231Segment    = 48 // longest percent-encoded RFC 2231 continuation
+	max2047Chunk      = 36 // most raw bytes per RFC 2047 encoded-word
+)
+
+/*
+dispositionHeader renders a Content-Disposition value for `filename`.
+
+Short, printable ASCII names are written as a quoted `filename` parameter.
+All others are written as an RFC 2231 `filename*` parameter (split into
+continuations if long), followed by an RFC 2047 encoded `filename` parameter
+as a fallback for clients that don't understand RFC 2231.
+*/
+func dispositionHeader(disposition, filename string) string {
+
+	bPlain := len(filename) <= maxQuotedFilename
+	for ix := 0; bPlain && (ix < len(filename)); ix++ {
+		bPlain = (filename[ix] >= 0x20) && (filename[ix] < 0x7F)
+	}
+	if bPlain {
+		return disposition + ";\r\n filename=" + quoteParam(filename)
+	}
+
+	// RFC 2231 PERCENT-ENCODING, SPLIT ON WHOLE ESCAPES
+	var sSegs []string
+	var seg strings.Builder
+	for ix := 0; ix < len(filename); ix++ {
+		if seg.Len() >= max2231Segment {
+			sSegs = append(sSegs, seg.String())
+			seg.Reset()
+		}
+		if c := filename[ix]; is2231AttrChar(c) {
+			seg.WriteByte(c)
+		} else {
+			fmt.Fprintf(&seg, "%%%02X", c)
+		}
+	}
+	sSegs = append(sSegs, seg.String())
+
+	var sb strings.Builder
+	sb.WriteString(disposition)
+	if len(sSegs) == 1 {
+		sb.WriteString(";\r\n filename*=UTF-8''" + sSegs[0])
+	} else {
+		for ix, seg := range sSegs {
+			if ix == 0 {
+				seg = "UTF-8''" + seg
+			}
+			fmt.Fprintf(&sb, ";\r\n filename*%d*=%s", ix, seg)
+		}
+	}
+
+	// RFC 2047 FALLBACK, FOLDED BETWEEN ENCODED-WORDS
+	sb.WriteString(";\r\n filename=\"")
+	for ix, chunk := range splitRunes(filename, max2047Chunk) {
+		if ix > 0 {
+			sb.WriteString("\r\n ")
+		}
+		sb.WriteString("=?UTF-8?b?" + base64.StdEncoding.EncodeToString([]byte(chunk)) + "?=")
+	}
+	sb.WriteString("\"")
+	return sb.String()
+}
+
+// splitRunes splits `s` into chunks of at most `n` bytes, without splitting
+// any UTF-8 sequence.
+func splitRunes(s string, n int) (chunks []string) {
+	for len(s) > n {
+		ix := n
+		for (ix > 0) && !utf8.RuneStart(s[ix]) {
+			ix--
+		}
+		chunks = append(chunks, s[:ix])
+		s = s[ix:]
+	}
+	return append(chunks, s)
+}
+
+// quoteParam renders a MIME parameter value as a quoted-string.
+func quoteParam(val string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for ix := 0; ix < len(val); ix++ {
+		if (val[ix] == '"') || (val[ix] == '\\') {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(val[ix])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// is2231AttrChar reports whether `c` may appear unescaped in an RFC 2231
+// extended parameter value.
+func is2231AttrChar(c byte) bool {
+	switch {
+	case (c >= 'a') && (c <= 'z'), (c >= 'A') && (c <= 'Z'), (c >= '0') && (c <= '9'):
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
 }
 
 /*
@@ -292,6 +536,24 @@ func (e *Email) AttachFile(filename string) (*Attachment, error) {
 	return e.Attach(f, basename, ct)
 }
 
+/*
+AttachFileLazy attaches a file to the email via filesystem, like AttachFile,
+but the file is only opened (and re-opened) while the message is being written.
+The file must exist when AttachFileLazy is called.
+*/
+func (e *Email) AttachFileLazy(filename string) (*Attachment, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	ct := mime.TypeByExtension(filepath.Ext(filename))
+	basename := filepath.Base(filename)
+	open := func() (io.ReadCloser, error) {
+		return os.Open(filename)
+	}
+	return e.AttachLazy(open, basename, ct), nil
+}
+
 // msgHeaders merges the Email's various fields and custom headers together in a
 // standards compliant way to create a MIMEHeader to be used in the resulting
 // message. It does not alter e.Headers.
@@ -345,6 +607,23 @@ func (e *Email) msgHeaders() (textproto.MIMEHeader, error) {
 	return res, nil
 }
 
+// withGeneratedHeaders returns a copy of the Email with its Message-Id and
+// Date headers set, so that every rendering of the copy is identical.
+func (e *Email) withGeneratedHeaders() (*Email, error) {
+	mHdr, err := e.msgHeaders()
+	if err != nil {
+		return nil, err
+	}
+	pMsg := *e
+	pMsg.Headers = make(textproto.MIMEHeader, len(e.Headers)+2)
+	for k, v := range e.Headers {
+		pMsg.Headers[k] = v
+	}
+	pMsg.Headers["Message-Id"] = mHdr["Message-Id"]
+	pMsg.Headers["Date"] = mHdr["Date"]
+	return &pMsg, nil
+}
+
 func writeMessage(buff io.Writer, msg []byte, multipart bool, mediaType string, w *multipart.Writer) error {
 	if multipart {
 		header := textproto.MIMEHeader{
@@ -371,89 +650,289 @@ needed MIMEHeaders, boundaries, etc.
 func (e *Email) Bytes() ([]byte, error) {
 	// TODO: better guess buffer size
 	buff := bytes.NewBuffer(make([]byte, 0, 4096))
+	if _, err := e.WriteTo(buff); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+/*
+WriteTo streams the Email to `w` in the same form as Bytes(), without first
+rendering the whole message in memory.  Implements io.WriterTo.
+*/
+func (e *Email) WriteTo(w io.Writer) (int64, error) {
+	return e.writeTo(w, writeOpts{})
+}
+
+// writeOpts adapt a rendered message to what an SMTP session allows.
+type writeOpts struct {
+	bBinary bool // leave attachments unencoded (BINARYMIME; see Client.BinaryMIME)
+	bUTF8   bool // write headers as raw UTF-8 (SMTPUTF8; see RFC 6532)
+}
+
+// writeTo is WriteTo, with the given options.
+func (e *Email) writeTo(w io.Writer, opt writeOpts) (int64, error) {
+
+	cw := &countWriter{w: w}
 
 	headers, err := e.msgHeaders()
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	var wrapper entityWrapper
+	switch {
+	case (e.SMIME != nil) && (e.OpenPGP != nil):
+		return 0, ErrSMIMEAndOpenPGP
+	case e.SMIME != nil:
+		wrapper = e.SMIME
+	case e.OpenPGP != nil:
+		wrapper = e.OpenPGP
+	default:
+		err = e.writeEntity(cw, headers, opt)
+		return cw.n, err
+	}
+
+	// S/MIME & OPENPGP PROTECT THE CONTENT ENTITY, RENDERED WITHOUT THE MESSAGE HEADERS
+	var content bytes.Buffer
+	if err = e.writeEntity(&countWriter{w: &content}, textproto.MIMEHeader{}, writeOpts{}); err != nil {
+		return 0, err
+	}
+	mHdr, body, err := wrapper.wrap(content.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	headers.Del("Content-Transfer-Encoding")
+	for k, v := range mHdr {
+		headers[k] = v
+	}
+	writeHeader(cw, headers, opt.bUTF8)
+	io.WriteString(cw, "\r\n")
+	cw.Write(body)
+	return cw.n, cw.err
+}
+
+// writeEntity writes `headers` and the Email's content (bodies and
+// attachments), setting the Content-Type needed to hold them.
+func (e *Email) writeEntity(cw *countWriter, headers textproto.MIMEHeader, opt writeOpts) error {
+
+	sBodies := e.bodies()
+	hasHTML := false
+	for _, b := range sBodies {
+		hasHTML = hasHTML || (baseMediaType(b.ContentType) == "text/html")
+	}
+
+	// INLINE PARTS ONLY MAKE SENSE ALONGSIDE AN HTML BODY
+	var sInline, sAttached []*Attachment
+	for _, a := range e.Attachments {
+		if a.Inline && hasHTML {
+			sInline = append(sInline, a)
+		} else {
+			sAttached = append(sAttached, a)
+		}
 	}
 
 	var (
-		isMixed       = len(e.Attachments) > 0
-		isAlternative = len(e.Text) > 0 && len(e.HTML) > 0
+		isMixed       = len(sAttached) > 0
+		isAlternative = len(sBodies) > 1
+		isRelated     = len(sInline) > 0
 	)
 
-	var w *multipart.Writer
-	if isMixed || isAlternative {
-		w = multipart.NewWriter(buff)
+	var mw *multipart.Writer
+	if isMixed || isAlternative || isRelated {
+		mw = multipart.NewWriter(cw)
 	}
 	switch {
 	case isMixed:
-		headers.Set("Content-Type", "multipart/mixed;\r\n boundary="+w.Boundary())
+		headers.Set("Content-Type", "multipart/mixed;\r\n boundary="+mw.Boundary())
+		headers.Del("Content-Transfer-Encoding")
 	case isAlternative:
-		headers.Set("Content-Type", "multipart/alternative;\r\n boundary="+w.Boundary())
-	case len(e.HTML) > 0:
-		headers.Set("Content-Type", "text/html; charset=UTF-8")
+		headers.Set("Content-Type", "multipart/alternative;\r\n boundary="+mw.Boundary())
+		headers.Del("Content-Transfer-Encoding")
+	case isRelated:
+		headers.Set("Content-Type", relatedContentType(mw))
+		headers.Del("Content-Transfer-Encoding")
+	case len(sBodies) == 1:
+		headers.Set("Content-Type", sBodies[0].ContentType+"; charset=UTF-8")
 		headers.Set("Content-Transfer-Encoding", "quoted-printable")
 	default:
 		headers.Set("Content-Type", "text/plain; charset=UTF-8")
 		headers.Set("Content-Transfer-Encoding", "quoted-printable")
 	}
-	headerToBytes(buff, headers)
-	_, err = io.WriteString(buff, "\r\n")
-	if err != nil {
-		return nil, err
+	writeHeader(cw, headers, opt.bUTF8)
+	if _, err := io.WriteString(cw, "\r\n"); err != nil {
+		return err
 	}
 
-	// Check to see if there is a Text or HTML field
-	if len(e.Text) > 0 || len(e.HTML) > 0 {
-		var subWriter *multipart.Writer
+	// Check to see if there are any bodies
+	if len(sBodies) > 0 {
 
+		// Create the multipart alternative part
+		altWriter := mw
 		if isMixed && isAlternative {
-			// Create the multipart alternative part
-			subWriter = multipart.NewWriter(buff)
+			altWriter = multipart.NewWriter(cw)
 			header := textproto.MIMEHeader{
-				"Content-Type": {"multipart/alternative;\r\n boundary=" + subWriter.Boundary()},
+				"Content-Type": {"multipart/alternative;\r\n boundary=" + altWriter.Boundary()},
 			}
-			if _, err := w.CreatePart(header); err != nil {
-				return nil, err
+			if _, err := mw.CreatePart(header); err != nil {
+				return err
 			}
-		} else {
-			subWriter = w
 		}
 		// Create the body sections
-		if len(e.Text) > 0 {
-			// Write the text
-			if err := writeMessage(buff, e.Text, isMixed || isAlternative, "text/plain", subWriter); err != nil {
-				return nil, err
+		bRelated := false
+		for _, b := range sBodies {
+			if (baseMediaType(b.ContentType) != "text/html") || bRelated {
+				if err := writeMessage(cw, b.Content, mw != nil, b.ContentType, altWriter); err != nil {
+					return err
+				}
+				continue
 			}
-		}
-		if len(e.HTML) > 0 {
-			// Write the HTML
-			if err := writeMessage(buff, e.HTML, isMixed || isAlternative, "text/html", subWriter); err != nil {
-				return nil, err
+			// Create the multipart related part
+			bRelated = true
+			relWriter := altWriter
+			if isRelated && (isMixed || isAlternative) {
+				relWriter = multipart.NewWriter(cw)
+				header := textproto.MIMEHeader{
+					"Content-Type": {relatedContentType(relWriter)},
+				}
+				if _, err := altWriter.CreatePart(header); err != nil {
+					return err
+				}
+			}
+			// Write the HTML, followed by the parts it references
+			if err := writeMessage(cw, b.Content, mw != nil, b.ContentType, relWriter); err != nil {
+				return err
+			}
+			for _, a := range sInline {
+				if err := writeAttachment(relWriter, a, opt.bBinary); err != nil {
+					return err
+				}
+			}
+			if relWriter != altWriter {
+				if err := relWriter.Close(); err != nil {
+					return err
+				}
 			}
 		}
-		if isMixed && isAlternative {
-			if err := subWriter.Close(); err != nil {
-				return nil, err
+		if altWriter != mw {
+			if err := altWriter.Close(); err != nil {
+				return err
 			}
 		}
 	}
 	// Create attachment part, if necessary
-	for _, a := range e.Attachments {
-		ap, err := w.CreatePart(a.Header)
-		if err != nil {
-			return nil, err
+	for _, a := range sAttached {
+		if err := writeAttachment(mw, a, opt.bBinary); err != nil {
+			return err
+		}
+	}
+	if mw != nil {
+		if err := mw.Close(); err != nil {
+			return err
+		}
+	}
+	return cw.err
+}
+
+// bodies gathers the Email's alternative bodies, ordered from least to most
+// preferred.
+func (e *Email) bodies() []Body {
+	var sBodies []Body
+	if len(e.Text) > 0 {
+		sBodies = append(sBodies, Body{ContentType: "text/plain", Content: e.Text})
+	} else if e.AutoText && (len(e.HTML) > 0) {
+		sBodies = append(sBodies, Body{ContentType: "text/plain", Content: HTMLToText(e.HTML)})
+	}
+	if len(e.HTML) > 0 {
+		sBodies = append(sBodies, Body{ContentType: "text/html", Content: e.HTML})
+	}
+	if len(e.Calendar) > 0 {
+		sBodies = append(sBodies, Body{ContentType: calendarMediaType(e.Calendar), Content: e.Calendar})
+	}
+	for _, b := range e.Alternatives {
+		if len(b.Content) > 0 {
+			sBodies = append(sBodies, b)
+		}
+	}
+	sort.SliceStable(sBodies, func(i, j int) bool {
+		return alternativeRank(sBodies[i].ContentType) < alternativeRank(sBodies[j].ContentType)
+	})
+	return sBodies
+}
+
+/*
+alternativeRank orders bodies within multipart/alternative, where the last is
+the most preferred (RFC 2046 section 5.1.4): plain text first, then
+unrecognized types, text/watch-html (which Apple Watch looks for ahead of
+text/html), text/x-amp-html (which must precede text/html, as a fallback for
+clients without AMP), text/html, and finally text/calendar, which mail clients
+expect last.
+*/
+func alternativeRank(contentType string) int {
+	switch baseMediaType(contentType) {
+	case "text/plain":
+		return 0
+	case "text/watch-html":
+		return 2
+	case "text/x-amp-html":
+		return 3
+	case "text/html":
+		return 4
+	case "text/calendar":
+		return 5
+	}
+	return 1
+}
+
+// baseMediaType is the lowercase media type of a Content-Type, sans parameters.
+func baseMediaType(contentType string) string {
+	if ix := strings.IndexByte(contentType, ';'); ix >= 0 {
+		contentType = contentType[:ix]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// relatedContentType is the Content-Type of a multipart/related entity
+// holding an HTML body and its inline parts.
+func relatedContentType(w *multipart.Writer) string {
+	return "multipart/related; type=\"text/html\";\r\n boundary=" + w.Boundary()
+}
+
+// writeAttachment writes an attachment as a base64-encoded part of `w`, or
+// as-is if `bBinary`.
+func writeAttachment(w *multipart.Writer, a *Attachment, bBinary bool) error {
+	// content is always re-encoded, regardless of how it was received
+	aHdr := make(textproto.MIMEHeader, len(a.Header)+1)
+	for k, v := range a.Header {
+		aHdr[k] = v
+	}
+	if bBinary {
+		aHdr.Set("Content-Transfer-Encoding", "binary")
+	} else {
+		aHdr.Set("Content-Transfer-Encoding", "base64")
+	}
+	ap, err := w.CreatePart(aHdr)
+	if err != nil {
+		return err
+	}
+	if a.Open == nil {
+		if bBinary {
+			_, err = ap.Write(a.Content)
+			return err
 		}
 		// Write the base64Wrapped content to the part
 		base64Wrap(ap, a.Content)
+		return nil
 	}
-	if isMixed || isAlternative {
-		if err := w.Close(); err != nil {
-			return nil, err
-		}
+	rc, err := a.Open()
+	if err != nil {
+		return err
 	}
-	return buff.Bytes(), nil
+	defer rc.Close()
+	if bBinary {
+		_, err = io.Copy(ap, rc)
+		return err
+	}
+	return base64WrapReader(ap, rc)
 }
 
 // base64Wrap encodes the attachment content, and wraps it according to RFC 2045 standards (every 76 chars)
@@ -479,21 +958,69 @@ func base64Wrap(w io.Writer, b []byte) {
 	}
 }
 
+// countWriter counts bytes written to `w`, and holds onto the first write
+// error, after which all writes are discarded.
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// base64WrapReader is base64Wrap for content streamed from an io.Reader.
+func base64WrapReader(w io.Writer, r io.Reader) error {
+	// whole lines' worth of raw bytes, so that lines continue across chunks
+	buf := make([]byte, 57*64)
+	for {
+		n, err := io.ReadFull(r, buf)
+		base64Wrap(w, buf[:n])
+		if (err == io.EOF) || (err == io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // headerToBytes renders "header" to "buff". If there are multiple values for a
-// field, multiple "Field: value\r\n" lines will be emitted.
+// field, multiple "Field: value\r\n" lines will be emitted.  Fields are written
+// in a deterministic order (see headerOrder), and long values are folded.
 func headerToBytes(buff io.Writer, header textproto.MIMEHeader) {
-	for field, vals := range header {
-		for _, subval := range vals {
+	writeHeader(buff, header, false)
+}
+
+// writeHeader is headerToBytes, leaving UTF-8 unencoded if `bUTF8` (for
+// SMTPUTF8 sessions, per RFC 6532).
+func writeHeader(buff io.Writer, header textproto.MIMEHeader, bUTF8 bool) {
+	for _, field := range sortedHeaderFields(header) {
+		for _, subval := range header[field] {
 			// bytes.Buffer.Write() never returns an error.
 			io.WriteString(buff, field)
 			io.WriteString(buff, ": ")
 			// Write the encoded header if needed
 			switch {
 			case field == "Content-Type" || field == "Content-Disposition":
-				buff.Write([]byte(subval))
-			default:
-				buff.Write([]byte(mime.QEncoding.Encode("UTF-8", subval)))
+				// parameters are encoded by whoever set them
+			case isAddressHeader(field):
+				if addrs, ok := formatAddressList(subval, bUTF8); ok {
+					subval = addrs
+				} else if !bUTF8 {
+					subval = mime.QEncoding.Encode("UTF-8", subval)
+				}
+			case !bUTF8:
+				subval = mime.QEncoding.Encode("UTF-8", subval)
 			}
+			io.WriteString(buff, foldHeader(field, subval))
 			io.WriteString(buff, "\r\n")
 		}
 	}
@@ -0,0 +1,514 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// iCalendar scheduling methods (RFC 5546), for Event.Method.
+const (
+	MethodPublish = "PUBLISH"
+	MethodRequest = "REQUEST"
+	MethodReply   = "REPLY"
+	MethodCancel  = "CANCEL"
+)
+
+// Attendee is an ORGANIZER or ATTENDEE of an Event.
+type Attendee struct {
+	Name     string // common name (CN) (optional)
+	Email    string
+	Role     string // e.g. REQ-PARTICIPANT (default), OPT-PARTICIPANT, CHAIR
+	PartStat string // participation status: e.g. NEEDS-ACTION (default), ACCEPTED, DECLINED, TENTATIVE
+	RSVP     bool   // whether a reply is requested
+}
+
+/*
+Event is a single iCalendar (RFC 5545) VEVENT, along with the scheduling
+Method of the calendar object that carries it.
+
+Start & End are written in Start's time.Location, along with a VTIMEZONE
+describing it, unless that location is UTC (or time.Local, whose name is no
+TZID).  Set RRule (e.g. "FREQ=WEEKLY;BYDAY=MO;COUNT=10") to make the event
+recur.
+
+Render it with Bytes(), and set the result as Email.Calendar to send it as an
+invitation (METHOD=REQUEST) or cancellation (METHOD=CANCEL).
+*/
+type Event struct {
+	Method      string // MethodRequest (default), MethodCancel, MethodReply, etc.
+	UID         string // unique, persistent event identifier; generated if empty
+	Sequence    int    // revision number; increment for each update sent
+	Status      string // e.g. CONFIRMED, TENTATIVE, CANCELLED (default for MethodCancel)
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         time.Time
+	AllDay      bool   // Start & End are dates; End is exclusive
+	RRule       string // recurrence rule (optional)
+	Organizer   Attendee
+	Attendees   []Attendee
+}
+
+const (
+	icalDate     = "20060102"
+	icalDateTime = "20060102T150405"
+	// maxICalLine is the maximum iCalendar content line length, in octets
+	maxICalLine = 75
+)
+
+/*
+Bytes renders the Event as an iCalendar object.  An Organizer is required, as
+is a Start time.  ErrInvalidEvent is also returned for an unknown Method or
+Status, and for control characters in fields that are not escaped.
+*/
+func (ev *Event) Bytes() ([]byte, error) {
+
+	if ev.Start.IsZero() || (len(ev.Organizer.Email) == 0) || !ev.valid() {
+		return nil, ErrInvalidEvent
+	}
+	method := strings.ToUpper(ev.Method)
+	if len(method) == 0 {
+		method = MethodRequest
+	}
+	uid := ev.UID
+	if len(uid) == 0 {
+		id, err := generateMessageID()
+		if err != nil {
+			return nil, err
+		}
+		uid = trimContentID(id)
+	}
+	status := strings.ToUpper(ev.Status)
+	if (len(status) == 0) && (method == MethodCancel) {
+		status = "CANCELLED"
+	}
+
+	var buf bytes.Buffer
+	line := func(name, val string) {
+		buf.WriteString(foldICalLine(name + ":" + val))
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("PRODID", "-//BourgeoisBear//email.v2//EN")
+	line("VERSION", "2.0")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", method)
+
+	// TIMEZONE
+	loc := ev.Start.Location()
+	tzid := loc.String()
+	if ev.AllDay || (loc == time.UTC) || (tzid == "UTC") || (tzid == "Local") {
+		tzid = ""
+	}
+	if len(tzid) > 0 {
+		buf.WriteString(vtimezone(loc, ev.Start.Year()))
+	}
+	icalTime := func(name string, t time.Time) {
+		switch {
+		case ev.AllDay:
+			line(name+";VALUE=DATE", t.Format(icalDate))
+		case len(tzid) > 0:
+			line(name+";TZID="+icalParam(tzid), t.In(loc).Format(icalDateTime))
+		default:
+			line(name, t.UTC().Format(icalDateTime)+"Z")
+		}
+	}
+
+	line("BEGIN", "VEVENT")
+	line("UID", icalText(uid))
+	line("DTSTAMP", time.Now().UTC().Format(icalDateTime)+"Z")
+	line("SEQUENCE", strconv.Itoa(ev.Sequence))
+	icalTime("DTSTART", ev.Start)
+	if !ev.End.IsZero() {
+		icalTime("DTEND", ev.End)
+	}
+	if len(ev.RRule) > 0 {
+		line("RRULE", ev.RRule)
+	}
+	if len(status) > 0 {
+		line("STATUS", status)
+	}
+	if len(ev.Summary) > 0 {
+		line("SUMMARY", icalText(ev.Summary))
+	}
+	if len(ev.Description) > 0 {
+		line("DESCRIPTION", icalText(ev.Description))
+	}
+	if len(ev.Location) > 0 {
+		line("LOCATION", icalText(ev.Location))
+	}
+	buf.WriteString(foldICalLine(ev.Organizer.property("ORGANIZER", false)))
+	for _, att := range ev.Attendees {
+		buf.WriteString(foldICalLine(att.property("ATTENDEE", true)))
+	}
+	line("END", "VEVENT")
+	line("END", "VCALENDAR")
+	return buf.Bytes(), nil
+}
+
+/*
+valid checks the fields that are written without escaping: METHOD and STATUS
+must be known values, and the rest must hold no control characters (which
+could begin new content lines), nor (for parameters) delimiters.
+*/
+func (ev *Event) valid() bool {
+
+	switch strings.ToUpper(ev.Method) {
+	case "", MethodPublish, MethodRequest, MethodReply, "ADD", MethodCancel, "REFRESH", "COUNTER", "DECLINECOUNTER":
+	default:
+		return false
+	}
+	switch strings.ToUpper(ev.Status) {
+	case "", "TENTATIVE", "CONFIRMED", "CANCELLED":
+	default:
+		return false
+	}
+
+	bValid := !hasICalControl(ev.RRule)
+	for _, att := range append([]Attendee{ev.Organizer}, ev.Attendees...) {
+		bValid = bValid && !hasICalControl(att.Email) &&
+			!strings.ContainsAny(att.Role, ";:,\"\x7f") && !hasICalControl(att.Role) &&
+			!strings.ContainsAny(att.PartStat, ";:,\"\x7f") && !hasICalControl(att.PartStat)
+	}
+	return bValid
+}
+
+// hasICalControl reports whether `s` holds control characters (CR, LF, etc.).
+func hasICalControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return (r < ' ') || (r == 0x7f)
+	}) >= 0
+}
+
+// property renders the attendee as an iCalendar property (sans folding).
+func (att Attendee) property(name string, bAttendee bool) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(att.Name) > 0 {
+		sb.WriteString(";CN=" + icalParam(att.Name))
+	}
+	if bAttendee {
+		role, stat := att.Role, att.PartStat
+		if len(role) == 0 {
+			role = "REQ-PARTICIPANT"
+		}
+		if len(stat) == 0 {
+			stat = "NEEDS-ACTION"
+		}
+		sb.WriteString(";ROLE=" + strings.ToUpper(role) + ";PARTSTAT=" + strings.ToUpper(stat))
+		if att.RSVP {
+			sb.WriteString(";RSVP=TRUE")
+		}
+	}
+	sb.WriteString(":mailto:" + att.Email)
+	return sb.String()
+}
+
+/*
+vtimezone describes `loc` as a VTIMEZONE, with a yearly rule for each of the
+offset transitions it makes during `year`.  Transitions are assumed to fall on
+the same weekday of the month every year, which holds for the common zones.
+*/
+func vtimezone(loc *time.Location, year int) string {
+
+	var buf bytes.Buffer
+	line := func(name, val string) {
+		buf.WriteString(foldICalLine(name + ":" + val))
+	}
+	offset := func(secs int) string {
+		sign := "+"
+		if secs < 0 {
+			sign, secs = "-", -secs
+		}
+		return fmt.Sprintf("%s%02d%02d", sign, secs/3600, (secs/60)%60)
+	}
+
+	line("BEGIN", "VTIMEZONE")
+	line("TZID", loc.String())
+
+	// FIND EACH TRANSITION BY DAY, THEN NARROW IT DOWN TO THE MINUTE
+	nTrans := 0
+	t := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	for end := t.AddDate(1, 0, 0); t.Before(end); {
+		next := t.Add(24 * time.Hour)
+		_, offFrom := t.Zone()
+		if _, offTo := next.Zone(); offTo != offFrom {
+			lo, hi := t, next
+			for hi.Sub(lo) > time.Minute {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if _, off := mid.Zone(); off == offFrom {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			trans := hi.Truncate(time.Minute)
+			name, offTo := trans.Zone()
+
+			// LOCAL WALL TIME AT WHICH THE TRANSITION OCCURS, IN THE OLD OFFSET
+			wall := trans.In(time.FixedZone("", offFrom))
+			nWeek := (wall.Day()-1)/7 + 1
+			if wall.AddDate(0, 0, 7).Month() != wall.Month() {
+				nWeek = -1
+			}
+			component := "STANDARD"
+			if trans.IsDST() {
+				component = "DAYLIGHT"
+			}
+			line("BEGIN", component)
+			line("DTSTART", wall.Format(icalDateTime))
+			line("RRULE", fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%d%s", wall.Month(), nWeek, strings.ToUpper(wall.Weekday().String()[:2])))
+			line("TZOFFSETFROM", offset(offFrom))
+			line("TZOFFSETTO", offset(offTo))
+			line("TZNAME", icalText(name))
+			line("END", component)
+			nTrans++
+		}
+		t = next
+	}
+
+	// FIXED OFFSET
+	if nTrans == 0 {
+		name, off := t.Zone()
+		line("BEGIN", "STANDARD")
+		line("DTSTART", "19700101T000000")
+		line("TZOFFSETFROM", offset(off))
+		line("TZOFFSETTO", offset(off))
+		line("TZNAME", icalText(name))
+		line("END", "STANDARD")
+	}
+
+	line("END", "VTIMEZONE")
+	return buf.String()
+}
+
+// icalText escapes an iCalendar TEXT value.
+func icalText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`,
+	).Replace(s)
+}
+
+// icalParam quotes an iCalendar parameter value, if needed.
+func icalParam(s string) string {
+	s = strings.NewReplacer(`"`, "'", "\r", " ", "\n", " ").Replace(s)
+	if strings.ContainsAny(s, ":;,") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// foldICalLine folds a content line to maxICalLine octets, per RFC 5545
+// section 3.1, without splitting UTF-8 sequences.
+func foldICalLine(s string) string {
+	var sb strings.Builder
+	nMax := maxICalLine
+	for len(s) > nMax {
+		ix := nMax
+		for (ix > 0) && !utf8.RuneStart(s[ix]) {
+			ix--
+		}
+		sb.WriteString(s[:ix])
+		sb.WriteString("\r\n ")
+		s = s[ix:]
+		// continuation lines begin with a space
+		nMax = maxICalLine - 1
+	}
+	sb.WriteString(s)
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// icalLine is an unfolded iCalendar content line.
+type icalLine struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// unfoldICal splits iCalendar data into unfolded content lines.
+func unfoldICal(data []byte) []icalLine {
+
+	var sRaw []string
+	for _, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if (len(raw) > 0) && (raw[0] == ' ' || raw[0] == '\t') && (len(sRaw) > 0) {
+			sRaw[len(sRaw)-1] += raw[1:]
+		} else if len(strings.TrimSpace(raw)) > 0 {
+			sRaw = append(sRaw, raw)
+		}
+	}
+
+	var ret []icalLine
+	for _, raw := range sRaw {
+		// NAME & PARAMS END AT THE FIRST UNQUOTED COLON
+		bQuote := false
+		ixColon := -1
+		for ix := 0; (ix < len(raw)) && (ixColon < 0); ix++ {
+			switch raw[ix] {
+			case '"':
+				bQuote = !bQuote
+			case ':':
+				if !bQuote {
+					ixColon = ix
+				}
+			}
+		}
+		if ixColon < 0 {
+			continue
+		}
+		ln := icalLine{Params: map[string]string{}, Value: raw[ixColon+1:]}
+		for iParam, param := range splitUnquoted(raw[:ixColon], ';') {
+			if iParam == 0 {
+				ln.Name = strings.ToUpper(param)
+				continue
+			}
+			if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+				ln.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+		ret = append(ret, ln)
+	}
+	return ret
+}
+
+// splitUnquoted splits `s` at each `sep` outside of double quotes.
+func splitUnquoted(s string, sep byte) []string {
+	var ret []string
+	bQuote := false
+	ixStart := 0
+	for ix := 0; ix < len(s); ix++ {
+		switch {
+		case s[ix] == '"':
+			bQuote = !bQuote
+		case (s[ix] == sep) && !bQuote:
+			ret = append(ret, s[ixStart:ix])
+			ixStart = ix + 1
+		}
+	}
+	return append(ret, s[ixStart:])
+}
+
+// icalUnescape reverses icalText.
+func icalUnescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// parseICalTime parses a DATE or DATE-TIME value, in its TZID (if known).
+func parseICalTime(ln icalLine) (t time.Time, bDate bool, err error) {
+	if (ln.Params["VALUE"] == "DATE") || (len(ln.Value) == len(icalDate)) {
+		t, err = time.Parse(icalDate, ln.Value)
+		return t, true, err
+	}
+	if strings.HasSuffix(ln.Value, "Z") {
+		t, err = time.Parse(icalDateTime, strings.TrimSuffix(ln.Value, "Z"))
+		return t, false, err
+	}
+	loc := time.UTC
+	if tzid := ln.Params["TZID"]; len(tzid) > 0 {
+		if l, eL := time.LoadLocation(tzid); eL == nil {
+			loc = l
+		}
+	}
+	t, err = time.ParseInLocation(icalDateTime, ln.Value, loc)
+	return t, false, err
+}
+
+// parseAttendee parses an ORGANIZER or ATTENDEE property.
+func parseAttendee(ln icalLine) Attendee {
+	addr := ln.Value
+	if strings.HasPrefix(strings.ToLower(addr), "mailto:") {
+		addr = addr[len("mailto:"):]
+	}
+	return Attendee{
+		Name:     ln.Params["CN"],
+		Email:    addr,
+		Role:     ln.Params["ROLE"],
+		PartStat: ln.Params["PARTSTAT"],
+		RSVP:     strings.EqualFold(ln.Params["RSVP"], "TRUE"),
+	}
+}
+
+/*
+ParseEvent parses the first VEVENT of iCalendar data, e.g. Email.Calendar from
+NewEmailFromReader, or the content of an .ics attachment.  For inbound replies
+(Method == MethodReply), each responding Attendee's PartStat holds their
+answer.  Cancellations have Method == MethodCancel.
+
+VTIMEZONE definitions are not interpreted: times given with a TZID are read in
+the time.Location of that name, if Go knows it, or else as UTC.
+*/
+func ParseEvent(data []byte) (*Event, error) {
+
+	ev := &Event{}
+	bInEvent, bFound := false, false
+	nSub := 0 // depth of components (e.g. VALARM) nested within the VEVENT
+	for _, ln := range unfoldICal(data) {
+		switch {
+		case ln.Name == "METHOD" && !bInEvent:
+			ev.Method = strings.ToUpper(ln.Value)
+		case ln.Name == "BEGIN" && !bInEvent:
+			bInEvent = !bFound && strings.EqualFold(ln.Value, "VEVENT")
+		case ln.Name == "BEGIN" && bInEvent:
+			nSub++
+		case ln.Name == "END" && bInEvent && (nSub > 0):
+			nSub--
+		case ln.Name == "END" && bInEvent:
+			bInEvent, bFound = false, true
+		case !bInEvent || (nSub > 0):
+			// outside the (first) VEVENT
+		case ln.Name == "UID":
+			ev.UID = icalUnescape(ln.Value)
+		case ln.Name == "SEQUENCE":
+			ev.Sequence, _ = strconv.Atoi(ln.Value)
+		case ln.Name == "STATUS":
+			ev.Status = strings.ToUpper(ln.Value)
+		case ln.Name == "SUMMARY":
+			ev.Summary = icalUnescape(ln.Value)
+		case ln.Name == "DESCRIPTION":
+			ev.Description = icalUnescape(ln.Value)
+		case ln.Name == "LOCATION":
+			ev.Location = icalUnescape(ln.Value)
+		case ln.Name == "RRULE":
+			ev.RRule = ln.Value
+		case ln.Name == "DTSTART":
+			t, bDate, err := parseICalTime(ln)
+			if err != nil {
+				return nil, err
+			}
+			ev.Start, ev.AllDay = t, bDate
+		case ln.Name == "DTEND":
+			t, _, err := parseICalTime(ln)
+			if err != nil {
+				return nil, err
+			}
+			ev.End = t
+		case ln.Name == "ORGANIZER":
+			ev.Organizer = parseAttendee(ln)
+		case ln.Name == "ATTENDEE":
+			ev.Attendees = append(ev.Attendees, parseAttendee(ln))
+		}
+	}
+	if !bFound {
+		return nil, ErrNoEvent
+	}
+	return ev, nil
+}
+
+// calendarMediaType is the Content-Type (sans charset) for iCalendar data,
+// with its METHOD, which mail clients need to offer scheduling actions.
+func calendarMediaType(data []byte) string {
+	for _, ln := range unfoldICal(data) {
+		if ln.Name == "METHOD" {
+			return "text/calendar; method=" + strings.ToUpper(strings.TrimSpace(ln.Value))
+		}
+		if ln.Name == "BEGIN" && !strings.EqualFold(ln.Value, "VCALENDAR") {
+			break
+		}
+	}
+	return "text/calendar"
+}
@@ -0,0 +1,269 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DKIM canonicalization algorithms, per RFC 6376 section 3.4.
+const (
+	DKIMSimple  = "simple"
+	DKIMRelaxed = "relaxed"
+)
+
+// DefaultDKIMHeaders are the header fields signed when DKIMSigner.Headers is empty.
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-Id", "In-Reply-To", "References",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+/*
+DKIMSigner adds an RFC 6376 DKIM-Signature header to outgoing messages.
+
+Key must be an *rsa.PrivateKey (rsa-sha256) or an ed25519.PrivateKey
+(ed25519-sha256, RFC 8463).  Canonicalization defaults to relaxed/relaxed.
+
+Set Client.DKIM (or SMTPClientConfig.DKIM) to sign every message sent.  Since
+the body must be hashed before the signature header can be written, signed
+messages are rendered in memory rather than streamed.
+*/
+type DKIMSigner struct {
+	Domain      string        // signing domain (d=)
+	Selector    string        // key selector (s=)
+	Key         crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	Headers     []string      // header fields to sign (h=); defaults to DefaultDKIMHeaders
+	HeaderCanon string        // DKIMSimple or DKIMRelaxed; defaults to DKIMRelaxed
+	BodyCanon   string        // DKIMSimple or DKIMRelaxed; defaults to DKIMRelaxed
+	Identity    string        // agent or user identifier (i=) (optional)
+}
+
+// algorithm returns the DKIM signing algorithm (a=) for the signer's key.
+func (d *DKIMSigner) algorithm() (string, error) {
+	if d == nil || d.Key == nil || len(d.Domain) == 0 || len(d.Selector) == 0 {
+		return "", ErrInvalidDKIMSigner
+	}
+	switch d.Key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", ErrInvalidDKIMSigner
+}
+
+/*
+Sign returns a copy of the rendered message `msg` (e.g. from Email.Bytes())
+with a DKIM-Signature header prepended.
+*/
+func (d *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+
+	algo, err := d.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	hCanon := strings.ToLower(d.HeaderCanon)
+	if len(hCanon) == 0 {
+		hCanon = DKIMRelaxed
+	}
+	bCanon := strings.ToLower(d.BodyCanon)
+	if len(bCanon) == 0 {
+		bCanon = DKIMRelaxed
+	}
+	if (hCanon != DKIMSimple && hCanon != DKIMRelaxed) || (bCanon != DKIMSimple && bCanon != DKIMRelaxed) {
+		return nil, ErrInvalidDKIMSigner
+	}
+
+	sHdrs, body := splitMessage(msg)
+	bh := sha256.Sum256(canonicalBody(body, bCanon))
+
+	// SIGN EVERY INSTANCE OF EACH REQUESTED FIELD
+	sNames := d.Headers
+	if len(sNames) == 0 {
+		sNames = DefaultDKIMHeaders
+	}
+	var sSigned []string
+	for _, name := range sNames {
+		for _, hdr := range sHdrs {
+			if strings.EqualFold(headerName(hdr), name) {
+				sSigned = append(sSigned, strings.ToLower(name))
+			}
+		}
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + algo,
+		"c=" + hCanon + "/" + bCanon,
+		"d=" + d.Domain,
+		"s=" + d.Selector,
+	}
+	if len(d.Identity) > 0 {
+		tags = append(tags, "i="+d.Identity)
+	}
+	tags = append(tags,
+		fmt.Sprintf("t=%d", time.Now().Unix()),
+		"h="+strings.Join(sSigned, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bh[:]),
+		"b=",
+	)
+	sigHdr := "DKIM-Signature: " + foldHeader("DKIM-Signature", strings.Join(tags, "; "))
+
+	hash := sha256.New()
+	for _, hdr := range selectHeaders(sHdrs, sSigned) {
+		hash.Write([]byte(canonicalHeader(hdr, hCanon)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(sigHdr, hCanon), "\r\n")))
+	digest := hash.Sum(nil)
+
+	var sig []byte
+	if _, ok := d.Key.Public().(ed25519.PublicKey); ok {
+		sig, err = d.Key.Sign(rand.Reader, digest, crypto.Hash(0))
+	} else {
+		sig, err = d.Key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// APPEND SIGNATURE, FOLDED
+	var buf bytes.Buffer
+	buf.Grow(len(sigHdr) + len(msg) + 512)
+	buf.WriteString(sigHdr)
+	for _, chunk := range splitRunes(base64.StdEncoding.EncodeToString(sig), 64) {
+		buf.WriteString("\r\n\t")
+		buf.WriteString(chunk)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(msg)
+	return buf.Bytes(), nil
+}
+
+/*
+splitMessage splits a rendered message into its raw header fields (each
+including folding and its trailing CRLF), and its body.
+*/
+func splitMessage(msg []byte) (sHdrs []string, body []byte) {
+	for len(msg) > 0 {
+		ix := bytes.Index(msg, []byte("\r\n"))
+		if ix < 0 {
+			ix = len(msg)
+		} else {
+			ix += 2
+		}
+		line := msg[:ix]
+		msg = msg[ix:]
+		switch {
+		case (len(line) <= 2) && (len(bytes.TrimRight(line, "\r\n")) == 0):
+			return sHdrs, msg
+		case (line[0] == ' ' || line[0] == '\t') && (len(sHdrs) > 0):
+			sHdrs[len(sHdrs)-1] += string(line)
+		default:
+			sHdrs = append(sHdrs, string(line))
+		}
+	}
+	return sHdrs, nil
+}
+
+func headerName(hdr string) string {
+	if ix := strings.IndexByte(hdr, ':'); ix >= 0 {
+		return strings.TrimRight(hdr[:ix], " \t")
+	}
+	return ""
+}
+
+/*
+selectHeaders picks, for each name in `sNames`, the last not-yet-selected
+instance of that field in `sHdrs`, per RFC 6376 section 5.4.2.  Names with no
+remaining instance are skipped.
+*/
+func selectHeaders(sHdrs []string, sNames []string) []string {
+	used := make([]bool, len(sHdrs))
+	var ret []string
+	for _, name := range sNames {
+		for ix := len(sHdrs) - 1; ix >= 0; ix-- {
+			if !used[ix] && strings.EqualFold(headerName(sHdrs[ix]), strings.TrimSpace(name)) {
+				used[ix] = true
+				ret = append(ret, sHdrs[ix])
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// canonicalHeader canonicalizes a raw header field (with trailing CRLF).
+func canonicalHeader(hdr, canon string) string {
+	if canon == DKIMSimple {
+		return hdr
+	}
+	ix := strings.IndexByte(hdr, ':')
+	if ix < 0 {
+		return hdr
+	}
+	name := strings.ToLower(strings.TrimRight(hdr[:ix], " \t"))
+	val := strings.NewReplacer("\r\n", "").Replace(hdr[ix+1:])
+	return name + ":" + strings.TrimSpace(collapseWSP(val)) + "\r\n"
+}
+
+// canonicalBody canonicalizes a message body.
+func canonicalBody(body []byte, canon string) []byte {
+
+	sLines := strings.SplitAfter(string(body), "\r\n")
+	if canon == DKIMRelaxed {
+		for ix, line := range sLines {
+			bCRLF := strings.HasSuffix(line, "\r\n")
+			line = strings.TrimRight(collapseWSP(strings.TrimSuffix(line, "\r\n")), " ")
+			if bCRLF {
+				line += "\r\n"
+			}
+			sLines[ix] = line
+		}
+	}
+
+	// IGNORE TRAILING EMPTY LINES
+	ret := strings.Join(sLines, "")
+	for strings.HasSuffix(ret, "\r\n\r\n") {
+		ret = strings.TrimSuffix(ret, "\r\n")
+	}
+	if ret == "\r\n" {
+		ret = ""
+	}
+	if len(ret) > 0 && !strings.HasSuffix(ret, "\r\n") {
+		ret += "\r\n"
+	}
+	if (len(ret) == 0) && (canon == DKIMSimple) {
+		ret = "\r\n"
+	}
+	return []byte(ret)
+}
+
+// collapseWSP reduces each run of spaces & tabs to a single space.
+func collapseWSP(s string) string {
+	var sb strings.Builder
+	bWSP := false
+	for ix := 0; ix < len(s); ix++ {
+		if s[ix] == ' ' || s[ix] == '\t' {
+			bWSP = true
+			continue
+		}
+		if bWSP {
+			sb.WriteByte(' ')
+			bWSP = false
+		}
+		sb.WriteByte(s[ix])
+	}
+	if bWSP {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
@@ -0,0 +1,288 @@
+package email
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMKeyLookup fetches the DKIM key record (e.g. "v=DKIM1; k=rsa; p=...")
+// published for a signing domain & selector.
+type DKIMKeyLookup interface {
+	LookupDKIMKey(domain, selector string) (string, error)
+}
+
+// DKIMKeyLookupFunc adapts a function to the DKIMKeyLookup interface.
+type DKIMKeyLookupFunc func(domain, selector string) (string, error)
+
+// LookupDKIMKey calls fn(domain, selector).
+func (fn DKIMKeyLookupFunc) LookupDKIMKey(domain, selector string) (string, error) {
+	return fn(domain, selector)
+}
+
+// DKIMLookupDNS fetches DKIM key records from the TXT record at
+// `<selector>._domainkey.<domain>`.
+var DKIMLookupDNS DKIMKeyLookup = DKIMKeyLookupFunc(func(domain, selector string) (string, error) {
+	sTxt, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(sTxt, ""), nil
+})
+
+// DKIMKeyMap is an in-memory DKIMKeyLookup, holding key records by
+// `<selector>._domainkey.<domain>`.
+type DKIMKeyMap map[string]string
+
+// LookupDKIMKey returns the record for selector & domain, or ErrDKIMKeyUnavailable.
+func (m DKIMKeyMap) LookupDKIMKey(domain, selector string) (string, error) {
+	if rec, ok := m[selector+"._domainkey."+domain]; ok {
+		return rec, nil
+	}
+	return "", ErrDKIMKeyUnavailable
+}
+
+/*
+DKIMKeyRecord renders the DKIM key record to publish for a public key
+(*rsa.PublicKey or ed25519.PublicKey).
+*/
+func DKIMKeyRecord(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", ErrInvalidDKIMSigner
+}
+
+// DKIMResult is the outcome of verifying a single DKIM-Signature header.
+type DKIMResult struct {
+	Domain     string   // signing domain (d=)
+	Selector   string   // key selector (s=)
+	Identity   string   // agent or user identifier (i=)
+	Headers    []string // signed header fields (h=)
+	BodyLength int64    // signed body length (l=), or -1 if the whole body was signed
+	Err        error    // nil if the signature verified
+}
+
+/*
+VerifyDKIM checks every DKIM-Signature header of a raw RFC 5322 message, and
+returns one DKIMResult per signature, in header order.  Public keys are fetched
+through `keys` (e.g. DKIMLookupDNS, or a DKIMKeyMap).
+
+A message without signatures returns no results.  Bare LF line endings (as
+from a local mailbox file) are converted to CRLF before verification.
+*/
+func VerifyDKIM(msg []byte, keys DKIMKeyLookup) []DKIMResult {
+
+	sHdrs, body := splitMessage(toCRLF(msg))
+
+	var ret []DKIMResult
+	for _, hdr := range sHdrs {
+		if strings.EqualFold(headerName(hdr), "DKIM-Signature") {
+			ret = append(ret, verifyDKIMSignature(hdr, sHdrs, body, keys))
+		}
+	}
+	return ret
+}
+
+// parseDKIMTags parses a DKIM tag=value list, with whitespace removed from values.
+func parseDKIMTags(val string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(val, ";") {
+		if len(strings.TrimSpace(tag)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrDKIMMalformed
+		}
+		name := strings.TrimSpace(kv[0])
+		if _, ok := tags[name]; ok {
+			return nil, ErrDKIMMalformed
+		}
+		tags[name] = strings.Join(strings.Fields(kv[1]), "")
+	}
+	return tags, nil
+}
+
+// stripDKIMSignature empties the b= tag of a raw DKIM-Signature header.
+func stripDKIMSignature(hdr string) string {
+	ix := strings.IndexByte(hdr, ':')
+	sTags := strings.Split(hdr[ix+1:], ";")
+	for iTag, tag := range sTags {
+		if iEq := strings.IndexByte(tag, '='); (iEq >= 0) && (strings.TrimSpace(tag[:iEq]) == "b") {
+			sTags[iTag] = tag[:iEq+1]
+			if strings.HasSuffix(tag, "\r\n") {
+				sTags[iTag] += "\r\n"
+			}
+		}
+	}
+	return hdr[:ix+1] + strings.Join(sTags, ";")
+}
+
+func verifyDKIMSignature(sigHdr string, sHdrs []string, body []byte, keys DKIMKeyLookup) (res DKIMResult) {
+
+	res.BodyLength = -1
+
+	tags, err := parseDKIMTags(sigHdr[strings.IndexByte(sigHdr, ':')+1:])
+	if err != nil {
+		res.Err = err
+		return
+	}
+	for _, req := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[req]; !ok {
+			res.Err = ErrDKIMMalformed
+			return
+		}
+	}
+	res.Domain = tags["d"]
+	res.Selector = tags["s"]
+	res.Identity = tags["i"]
+	for _, name := range strings.Split(tags["h"], ":") {
+		res.Headers = append(res.Headers, strings.TrimSpace(name))
+	}
+
+	// VALIDATE TAGS
+	bFrom := false
+	for _, name := range res.Headers {
+		bFrom = bFrom || strings.EqualFold(name, "From")
+	}
+	if (tags["v"] != "1") || !bFrom || (tags["a"] != "rsa-sha256" && tags["a"] != "ed25519-sha256") {
+		res.Err = ErrDKIMMalformed
+		return
+	}
+	hCanon, bCanon := DKIMSimple, DKIMSimple
+	if c, ok := tags["c"]; ok {
+		sCanon := strings.SplitN(strings.ToLower(c), "/", 2)
+		hCanon = sCanon[0]
+		if len(sCanon) > 1 {
+			bCanon = sCanon[1]
+		}
+	}
+	if (hCanon != DKIMSimple && hCanon != DKIMRelaxed) || (bCanon != DKIMSimple && bCanon != DKIMRelaxed) {
+		res.Err = ErrDKIMMalformed
+		return
+	}
+	if l, ok := tags["l"]; ok {
+		if res.BodyLength, err = strconv.ParseInt(l, 10, 64); (err != nil) || (res.BodyLength < 0) {
+			res.Err = ErrDKIMMalformed
+			return
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			res.Err = ErrDKIMMalformed
+			return
+		}
+		if time.Now().Unix() > exp {
+			res.Err = ErrDKIMExpired
+			return
+		}
+	}
+
+	// BODY HASH
+	cBody := canonicalBody(body, bCanon)
+	if res.BodyLength >= 0 {
+		if res.BodyLength > int64(len(cBody)) {
+			res.Err = ErrDKIMBodyHash
+			return
+		}
+		cBody = cBody[:res.BodyLength]
+	}
+	bh := sha256.Sum256(cBody)
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		res.Err = ErrDKIMBodyHash
+		return
+	}
+
+	// PUBLIC KEY
+	pub, err := dkimPublicKey(keys, res.Domain, res.Selector, tags["a"])
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	// HEADER HASH
+	hash := sha256.New()
+	for _, hdr := range selectHeaders(sHdrs, res.Headers) {
+		hash.Write([]byte(canonicalHeader(hdr, hCanon)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(stripDKIMSignature(sigHdr), hCanon), "\r\n")))
+	digest := hash.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		res.Err = ErrDKIMMalformed
+		return
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) != nil {
+			res.Err = ErrDKIMSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, sig) {
+			res.Err = ErrDKIMSignature
+		}
+	}
+	return
+}
+
+// dkimPublicKey fetches and parses the key for a signature with algorithm `algo`.
+func dkimPublicKey(keys DKIMKeyLookup, domain, selector, algo string) (crypto.PublicKey, error) {
+
+	rec, err := keys.LookupDKIMKey(domain, selector)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := parseDKIMTags(rec)
+	if err != nil {
+		return nil, ErrDKIMKeyUnavailable
+	}
+	if v, ok := tags["v"]; ok && (v != "DKIM1") {
+		return nil, ErrDKIMKeyUnavailable
+	}
+	if len(tags["p"]) == 0 {
+		// empty key == revoked
+		return nil, ErrDKIMKeyUnavailable
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, ErrDKIMKeyUnavailable
+	}
+
+	k := tags["k"]
+	if len(k) == 0 {
+		k = "rsa"
+	}
+	switch {
+	case (k == "rsa") && (algo == "rsa-sha256"):
+		if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+			if pRSA, ok := pub.(*rsa.PublicKey); ok {
+				return pRSA, nil
+			}
+		}
+		if pRSA, err := x509.ParsePKCS1PublicKey(der); err == nil {
+			return pRSA, nil
+		}
+	case (k == "ed25519") && (algo == "ed25519-sha256"):
+		if len(der) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(der), nil
+		}
+	}
+	return nil, ErrDKIMKeyUnavailable
+}
@@ -1,5 +1,7 @@
 package email
 
+import "fmt"
+
 // MailErr is this package's sentinel error type
 type MailErr int
 
@@ -14,6 +16,34 @@ const (
 	ErrUnexpectedServerChallenge
 	ErrLateHELO
 	ErrHasCRLF
+	ErrMaxDepth
+	ErrMaxParts
+	ErrMaxBytes
+	ErrMaxHeaderBytes
+	ErrInvalidDKIMSigner
+	ErrDKIMMalformed
+	ErrDKIMBodyHash
+	ErrDKIMSignature
+	ErrDKIMKeyUnavailable
+	ErrDKIMExpired
+	ErrInvalidSMIME
+	ErrSMIMEMalformed
+	ErrSMIMEUnsupported
+	ErrSMIMENotSigned
+	ErrSMIMENotEncrypted
+	ErrSMIMESignature
+	ErrSMIMENoRecipient
+	ErrInvalidOpenPGP
+	ErrOpenPGPNotSigned
+	ErrOpenPGPNotEncrypted
+	ErrSMIMEAndOpenPGP
+	ErrInvalidEvent
+	ErrNoEvent
+	ErrMessageTooLarge
+	ErrInvalidDSN
+	ErrSMTPUTF8Required
+	ErrPartialDelivery
+	ErrSMIMEDecrypt
 )
 
 func (e MailErr) Error() string {
@@ -38,6 +68,100 @@ func (e MailErr) Error() string {
 		return "HELO called after other methods"
 	case ErrHasCRLF:
 		return "line must not contain CR or LF"
+	case ErrMaxDepth:
+		return "MIME entity nested too deeply"
+	case ErrMaxParts:
+		return "too many MIME entities"
+	case ErrMaxBytes:
+		return "MIME entity bodies too large"
+	case ErrMaxHeaderBytes:
+		return "MIME header block too large"
+	case ErrInvalidDKIMSigner:
+		return "DKIM signer requires a Domain, a Selector, an RSA or Ed25519 Key, and simple or relaxed canonicalization"
+	case ErrDKIMMalformed:
+		return "malformed or unsupported DKIM-Signature"
+	case ErrDKIMBodyHash:
+		return "DKIM body hash does not match"
+	case ErrDKIMSignature:
+		return "DKIM signature does not match"
+	case ErrDKIMKeyUnavailable:
+		return "DKIM public key unavailable, revoked, or invalid"
+	case ErrDKIMExpired:
+		return "DKIM signature expired"
+	case ErrInvalidSMIME:
+		return "S/MIME requires a Certificate and an RSA or ECDSA Key to sign, or RSA Recipients to encrypt to"
+	case ErrSMIMEMalformed:
+		return "malformed S/MIME message"
+	case ErrSMIMEUnsupported:
+		return "unsupported S/MIME algorithm or content type"
+	case ErrSMIMENotSigned:
+		return "message is not S/MIME signed"
+	case ErrSMIMENotEncrypted:
+		return "message is not S/MIME encrypted"
+	case ErrSMIMESignature:
+		return "S/MIME signature does not match"
+	case ErrSMIMENoRecipient:
+		return "S/MIME message is not encrypted to this certificate"
+	case ErrInvalidOpenPGP:
+		return "OpenPGP requires a Signer or an Encrypter"
+	case ErrOpenPGPNotSigned:
+		return "message is not OpenPGP/MIME signed"
+	case ErrOpenPGPNotEncrypted:
+		return "message is not OpenPGP/MIME encrypted"
+	case ErrSMIMEAndOpenPGP:
+		return "message cannot be protected with both S/MIME and OpenPGP"
+	case ErrInvalidEvent:
+		return "calendar event requires a Start time and an Organizer, known METHOD & STATUS values, and no control characters"
+	case ErrNoEvent:
+		return "no VEVENT found in iCalendar data"
+	case ErrMessageTooLarge:
+		return "message exceeds the server's SIZE limit"
+	case ErrSMTPUTF8Required:
+		return "address has a non-ASCII local part, and the server does not offer SMTPUTF8"
+	case ErrInvalidDSN:
+		return "DSN RET must be FULL or HDRS, and NOTIFY must be NEVER alone, or any of SUCCESS, FAILURE & DELAY"
+	case ErrPartialDelivery:
+		return "message sent to only some of its recipients"
+	case ErrSMIMEDecrypt:
+		return "S/MIME content could not be decrypted"
 	}
 	return "unknown MailErr"
 }
+
+/*
+SizeError is returned by Client.Send when a message is larger than the limit
+the server declares with the SIZE extension (RFC 1870).  Nothing is sent.
+errors.Is(err, ErrMessageTooLarge) also matches it.
+*/
+type SizeError struct {
+	Size  int64 // message size, in octets
+	Limit int64 // server's limit, in octets
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("message size of %d octets exceeds the server's limit of %d", e.Size, e.Limit)
+}
+
+// Is matches ErrMessageTooLarge.
+func (e *SizeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
+
+/*
+PartialDeliveryError is returned by Client.Send when Client.AllowPartial let a
+message go to only some of its recipients.  The message was sent; Result
+reports which recipients were rejected.  errors.Is(err, ErrPartialDelivery)
+also matches it.
+*/
+type PartialDeliveryError struct {
+	Result *SendResult
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return fmt.Sprintf("message sent to %d of %d recipients", len(e.Result.Accepted()), len(e.Result.Recipients))
+}
+
+// Is matches ErrPartialDelivery.
+func (e *PartialDeliveryError) Is(target error) bool {
+	return target == ErrPartialDelivery
+}
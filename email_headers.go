@@ -0,0 +1,156 @@
+package email
+
+import (
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// maxHeaderLine is the line length headers are folded to, per RFC 5322.
+const maxHeaderLine = 78
+
+// addressHeaders are header fields holding RFC 5322 address lists.
+var addressHeaders = map[string]bool{
+	"From":                        true,
+	"Sender":                      true,
+	"Reply-To":                    true,
+	"To":                          true,
+	"Cc":                          true,
+	"Bcc":                         true,
+	"Disposition-Notification-To": true,
+}
+
+func isAddressHeader(field string) bool {
+	return addressHeaders[textproto.CanonicalMIMEHeaderKey(field)]
+}
+
+/*
+formatAddressList renders a comma-separated list of addresses per RFC 5322,
+RFC 2047-encoding only the display names that need it.  Bare addresses are
+kept bare, and internationalized domains are converted to punycode.  Returns
+false if `val` is not a valid address list.
+
+If `bUTF8`, display names & addresses are left as raw UTF-8, per RFC 6532.
+*/
+func formatAddressList(val string, bUTF8 bool) (string, bool) {
+	sAddrs, err := mail.ParseAddressList(val)
+	if err != nil {
+		return "", false
+	}
+	sFmt := make([]string, len(sAddrs))
+	for ix, pAddr := range sAddrs {
+		if !bUTF8 {
+			// NOTE: a non-ASCII local part has no ASCII form, and is kept
+			if addr, err := asciiAddress(pAddr.Address); err == nil {
+				pAddr.Address = addr
+			}
+		}
+		switch {
+		case len(pAddr.Name) == 0:
+			sFmt[ix] = pAddr.Address
+		case bUTF8:
+			sFmt[ix] = quoteDisplayName(pAddr.Name) + " <" + pAddr.Address + ">"
+		default:
+			sFmt[ix] = pAddr.String()
+		}
+	}
+	return strings.Join(sFmt, ", "), true
+}
+
+// quoteDisplayName quotes a raw UTF-8 display name, where RFC 5322 requires.
+func quoteDisplayName(name string) string {
+	bQuote := false
+	for _, r := range name {
+		bAtext := (r >= 0x80) || (r == ' ') || isASCIILetter(byte(r)) || ((r >= '0') && (r <= '9')) ||
+			strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+		bQuote = bQuote || !bAtext
+	}
+	if !bQuote {
+		return name
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// headerOrder is the order in which well-known header fields are written.
+// All other fields follow, sorted by name.
+var headerOrder = []string{
+	"From",
+	"Sender",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Bcc",
+	"Subject",
+	"Date",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+	"Mime-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"Content-Disposition",
+	"Content-Id",
+}
+
+var headerRank = func() map[string]int {
+	ret := make(map[string]int, len(headerOrder))
+	for ix, field := range headerOrder {
+		ret[field] = ix
+	}
+	return ret
+}()
+
+// sortedHeaderFields returns the fields of `header` in canonical output order.
+func sortedHeaderFields(header textproto.MIMEHeader) []string {
+
+	rank := func(field string) int {
+		if ix, ok := headerRank[textproto.CanonicalMIMEHeaderKey(field)]; ok {
+			return ix
+		}
+		return len(headerOrder)
+	}
+
+	fields := make([]string, 0, len(header))
+	for field := range header {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		ri, rj := rank(fields[i]), rank(fields[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return fields[i] < fields[j]
+	})
+	return fields
+}
+
+/*
+foldHeader folds a header value at spaces, so that no line of "Field: value"
+is longer than maxHeaderLine where possible.  Existing folds are kept, and
+words longer than a line are left intact.
+*/
+func foldHeader(field, val string) string {
+	var sb strings.Builder
+	nLine := len(field) + len(": ")
+	for iLine, line := range strings.Split(val, "\r\n") {
+		if iLine > 0 {
+			sb.WriteString("\r\n")
+			nLine = 0
+		}
+		for ix, word := range strings.Split(line, " ") {
+			if ix > 0 {
+				if (nLine+1+len(word) > maxHeaderLine) && (len(strings.TrimSpace(word)) > 0) {
+					sb.WriteString("\r\n ")
+					nLine = 1
+				} else {
+					sb.WriteByte(' ')
+					nLine++
+				}
+			}
+			sb.WriteString(word)
+			nLine += len(word)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,488 @@
+package email
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+HTMLToText renders an HTML body as readable plain text, wrapped to
+MaxLineLength, for use as a text/plain alternative (see Email.AutoText).
+
+Conversion is best-effort: links become numbered footnotes, headings are
+underlined, list items are bulleted (or numbered) and indented, blockquotes
+are quoted with "> ", and images are replaced with their alt text.  Scripts,
+styles and other markup are dropped.
+*/
+func HTMLToText(body []byte) []byte {
+	c := htmlText{width: MaxLineLength}
+	c.convert(string(body))
+	return []byte(c.String())
+}
+
+// htmlList is an open <ul> or <ol>.
+type htmlList struct {
+	ordered bool
+	n       int    // number of the current item
+	bullet  string // bullet of the current item
+}
+
+// htmlLink is an open <a>.
+type htmlLink struct {
+	href  string // or "" if it gets no footnote
+	start int    // offset of the link text within htmlText.inline
+}
+
+// htmlText accumulates plain text converted from HTML.
+type htmlText struct {
+	width   int
+	out     strings.Builder
+	nLF     int             // newlines due before the next line of `out`
+	nLFQ    int             // blockquote depth of those newlines
+	inline  strings.Builder // text of the current paragraph, whitespace collapsed
+	bPre    bool            // inside <pre>
+	bBullet bool            // the next line begins a list item
+	lists   []htmlList
+	quotes  int // blockquote depth
+	head    int // heading level being collected, or 0
+	anchors []htmlLink
+	links   []string // footnoted URLs
+}
+
+// tags whose content is not rendered
+var htmlSkipTags = map[string]bool{
+	"head": true, "title": true, "script": true, "style": true, "template": true, "noscript": true,
+}
+
+// tags that separate blocks of text, and the newlines between them
+var htmlBlockTags = map[string]int{
+	"p": 2, "div": 1, "section": 1, "article": 1, "header": 1, "footer": 1, "main": 1, "nav": 1,
+	"aside": 1, "address": 1, "table": 2, "tr": 1, "dl": 2, "dt": 1, "dd": 1, "form": 1,
+	"fieldset": 1, "figure": 2, "figcaption": 1, "center": 1,
+}
+
+func (c *htmlText) convert(s string) {
+
+	for len(s) > 0 {
+		ix := strings.IndexByte(s, '<')
+		if ix < 0 {
+			c.text(s)
+			return
+		}
+		c.text(s[:ix])
+		s = s[ix:]
+
+		// COMMENTS, DECLARATIONS & PROCESSING INSTRUCTIONS
+		switch {
+		case strings.HasPrefix(s, "<!--"):
+			if ixEnd := strings.Index(s, "-->"); ixEnd >= 0 {
+				s = s[ixEnd+3:]
+			} else {
+				s = ""
+			}
+			continue
+		case strings.HasPrefix(s, "<!") || strings.HasPrefix(s, "<?"):
+			if ixEnd := strings.IndexByte(s, '>'); ixEnd >= 0 {
+				s = s[ixEnd+1:]
+			} else {
+				s = ""
+			}
+			continue
+		}
+
+		name, attrs, bClose, rest, ok := parseHTMLTag(s)
+		if !ok {
+			// a lone '<' is text
+			c.text("<")
+			s = s[1:]
+			continue
+		}
+		s = rest
+
+		if htmlSkipTags[name] && !bClose {
+			if ixEnd := indexFoldASCII(s, "</"+name); ixEnd >= 0 {
+				s = s[ixEnd:]
+			} else {
+				s = ""
+			}
+			continue
+		}
+		c.tag(name, attrs, bClose)
+	}
+}
+
+/*
+parseHTMLTag parses the tag at the start of `s`, returning its lowercase name,
+attributes (with entities decoded), whether it is a closing tag, and the
+remainder of `s`.
+*/
+func parseHTMLTag(s string) (name string, attrs map[string]string, bClose bool, rest string, ok bool) {
+
+	ix := 1
+	if (ix < len(s)) && (s[ix] == '/') {
+		bClose = true
+		ix++
+	}
+	ixName := ix
+	for (ix < len(s)) && (isASCIILetter(s[ix]) || (ix > ixName && s[ix] >= '0' && s[ix] <= '9')) {
+		ix++
+	}
+	if ix == ixName {
+		return "", nil, false, s, false
+	}
+	name = strings.ToLower(s[ixName:ix])
+
+	attrs = map[string]string{}
+	for ix < len(s) {
+		for (ix < len(s)) && strings.IndexByte(" \t\r\n\f/", s[ix]) >= 0 {
+			ix++
+		}
+		if ix >= len(s) {
+			break
+		}
+		if s[ix] == '>' {
+			return name, attrs, bClose, s[ix+1:], true
+		}
+		ixKey := ix
+		for (ix < len(s)) && strings.IndexByte(" \t\r\n\f/=>", s[ix]) < 0 {
+			ix++
+		}
+		key := strings.ToLower(s[ixKey:ix])
+		for (ix < len(s)) && strings.IndexByte(" \t\r\n\f", s[ix]) >= 0 {
+			ix++
+		}
+		val := ""
+		if (ix < len(s)) && (s[ix] == '=') {
+			ix++
+			for (ix < len(s)) && strings.IndexByte(" \t\r\n\f", s[ix]) >= 0 {
+				ix++
+			}
+			if (ix < len(s)) && (s[ix] == '"' || s[ix] == '\'') {
+				q := s[ix]
+				ixEnd := strings.IndexByte(s[ix+1:], q)
+				if ixEnd < 0 {
+					return name, attrs, bClose, "", true
+				}
+				val = s[ix+1 : ix+1+ixEnd]
+				ix += ixEnd + 2
+			} else {
+				ixVal := ix
+				for (ix < len(s)) && strings.IndexByte(" \t\r\n\f>", s[ix]) < 0 {
+					ix++
+				}
+				val = s[ixVal:ix]
+			}
+		}
+		if _, ok := attrs[key]; !ok && len(key) > 0 {
+			attrs[key] = html.UnescapeString(val)
+		}
+	}
+	return name, attrs, bClose, "", true
+}
+
+// indexFoldASCII is strings.Index, matching ASCII letters of (lowercase)
+// `substr` without regard to case.  Unlike searching strings.ToLower(s), the
+// index is always an offset into `s`.
+func indexFoldASCII(s, substr string) int {
+	for ix := 0; ix+len(substr) <= len(s); ix++ {
+		bMatch := true
+		for iSub := 0; bMatch && (iSub < len(substr)); iSub++ {
+			ch := s[ix+iSub]
+			if (ch >= 'A') && (ch <= 'Z') {
+				ch += 'a' - 'A'
+			}
+			bMatch = ch == substr[iSub]
+		}
+		if bMatch {
+			return ix
+		}
+	}
+	return -1
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// text adds character data, collapsing whitespace outside of <pre>.
+func (c *htmlText) text(s string) {
+	if len(s) == 0 {
+		return
+	}
+	s = html.UnescapeString(s)
+	if c.bPre {
+		c.inline.WriteString(strings.ReplaceAll(s, "\r\n", "\n"))
+		return
+	}
+	if isHTMLSpace(rune(s[0])) {
+		c.space()
+	}
+	for ix, word := range strings.FieldsFunc(s, isHTMLSpace) {
+		if ix > 0 {
+			c.space()
+		}
+		c.inline.WriteString(word)
+	}
+	if isHTMLSpace(rune(s[len(s)-1])) {
+		c.space()
+	}
+}
+
+func isHTMLSpace(r rune) bool {
+	// NOTE: U+00A0 (&nbsp;) is deliberately not whitespace
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f'
+}
+
+// space separates words of the current paragraph.
+func (c *htmlText) space() {
+	if (c.inline.Len() > 0) && !strings.HasSuffix(c.inline.String(), " ") {
+		c.inline.WriteByte(' ')
+	}
+}
+
+func (c *htmlText) tag(name string, attrs map[string]string, bClose bool) {
+
+	switch name {
+	case "br":
+		if c.bPre {
+			c.inline.WriteByte('\n')
+		} else {
+			c.block(1)
+		}
+	case "hr":
+		c.block(2)
+		c.emit(strings.Repeat("-", c.width-utf8.RuneCountInString(c.prefix(false))), true)
+		c.newlines(2)
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		// headings are underlined as they are flushed
+		c.block(2)
+		c.head = 0
+		if !bClose {
+			c.head = int(name[1] - '0')
+		}
+	case "pre":
+		c.block(2)
+		c.bPre = !bClose
+	case "blockquote":
+		if !bClose {
+			c.block(2)
+			c.quotes++
+		} else if c.quotes > 0 {
+			c.flush()
+			c.quotes--
+			c.newlines(2)
+		}
+	case "ul", "ol":
+		if !bClose {
+			c.block(1)
+			l := htmlList{ordered: name == "ol"}
+			if n, err := strconv.Atoi(attrs["start"]); err == nil {
+				l.n = n - 1
+			}
+			c.lists = append(c.lists, l)
+		} else if len(c.lists) > 0 {
+			c.flush()
+			c.lists = c.lists[:len(c.lists)-1]
+			c.newlines(1)
+		}
+		if len(c.lists) == 0 {
+			c.newlines(2)
+		}
+	case "li":
+		c.block(1)
+		if !bClose && (len(c.lists) > 0) {
+			l := &c.lists[len(c.lists)-1]
+			l.n++
+			l.bullet = "* "
+			if l.ordered {
+				l.bullet = strconv.Itoa(l.n) + ". "
+			}
+			c.bBullet = true
+		}
+	case "td", "th":
+		c.space()
+	case "img":
+		if alt := strings.TrimSpace(attrs["alt"]); len(alt) > 0 {
+			c.text(" [" + alt + "] ")
+		}
+	case "a":
+		if !bClose {
+			href := strings.TrimSpace(attrs["href"])
+			lower := strings.ToLower(href)
+			if strings.HasPrefix(href, "#") || strings.HasPrefix(lower, "javascript:") || strings.HasPrefix(lower, "cid:") {
+				href = ""
+			}
+			c.anchors = append(c.anchors, htmlLink{href: href, start: c.inline.Len()})
+		} else if n := len(c.anchors); n > 0 {
+			a := c.anchors[n-1]
+			c.anchors = c.anchors[:n-1]
+			linkText := ""
+			if a.start <= c.inline.Len() {
+				linkText = strings.TrimSpace(c.inline.String()[a.start:])
+			}
+			// LINKS THAT READ AS THEIR OWN URL NEED NO FOOTNOTE
+			bSelf := false
+			for _, scheme := range []string{"", "mailto:", "http://", "https://"} {
+				bSelf = bSelf || (linkText == strings.TrimPrefix(a.href, scheme))
+			}
+			if (len(a.href) > 0) && !bSelf {
+				c.links = append(c.links, a.href)
+				c.inline.WriteString("[" + strconv.Itoa(len(c.links)) + "]")
+			}
+		}
+	default:
+		if nLF, ok := htmlBlockTags[name]; ok {
+			c.block(nLF)
+		}
+	}
+}
+
+// prefix is the prefix of a line in the current block: `bFirst` for the
+// first line of a list item, which carries its bullet.
+func (c *htmlText) prefix(bFirst bool) string {
+	p := strings.Repeat("> ", c.quotes)
+	for ix, l := range c.lists {
+		if bFirst && (ix == len(c.lists)-1) {
+			p += l.bullet
+		} else {
+			p += strings.Repeat(" ", len(l.bullet))
+		}
+	}
+	return p
+}
+
+// block ends the current paragraph, leaving `n` newlines before the next.
+func (c *htmlText) block(n int) {
+	c.flush()
+	c.newlines(n)
+}
+
+/*
+newlines ensures that at least `n` newlines separate `out` from the next line
+written (unless `out` is empty).  Blank lines are quoted only when both of the
+blocks they separate are.
+*/
+func (c *htmlText) newlines(n int) {
+	if c.out.Len() == 0 {
+		return
+	}
+	if n > c.nLF {
+		c.nLF = n
+	}
+	if c.quotes < c.nLFQ {
+		c.nLFQ = c.quotes
+	}
+}
+
+// flush writes out the current paragraph, wrapped.
+func (c *htmlText) flush() {
+	s := c.inline.String()
+	c.inline.Reset()
+	if c.bPre {
+		// a newline just after <pre> is not content
+		s = strings.TrimPrefix(s, "\n")
+	} else {
+		s = strings.TrimSpace(s)
+	}
+	if len(strings.TrimSpace(s)) == 0 {
+		return
+	}
+	if c.head > 0 {
+		c.emit(s, false)
+		n := utf8.RuneCountInString(s)
+		if max := c.width - utf8.RuneCountInString(c.prefix(false)); n > max {
+			n = max
+		}
+		ch := "-"
+		if c.head == 1 {
+			ch = "="
+		}
+		c.emit(strings.Repeat(ch, n), true)
+		return
+	}
+	c.emit(s, c.bPre)
+}
+
+// emit writes text, wrapped to the line width unless `bRaw`, with each line prefixed.
+func (c *htmlText) emit(s string, bRaw bool) {
+	if c.out.Len() > 0 {
+		c.out.WriteByte('\n')
+		q := c.nLFQ
+		if c.quotes < q {
+			q = c.quotes
+		}
+		for ; c.nLF > 1; c.nLF-- {
+			c.out.WriteString(strings.TrimRight(strings.Repeat("> ", q), " ") + "\n")
+		}
+	}
+	bFirst := true
+	line := func(ln string) {
+		if !bFirst {
+			c.out.WriteByte('\n')
+		}
+		bFirst = false
+		p := c.prefix(c.bBullet)
+		c.bBullet = false
+		c.out.WriteString(strings.TrimRight(p+ln, " "))
+	}
+	if bRaw {
+		for _, ln := range strings.Split(strings.TrimRight(s, "\n"), "\n") {
+			line(ln)
+		}
+	} else {
+		for _, ln := range wrapWords(s, c.width-utf8.RuneCountInString(c.prefix(c.bBullet))) {
+			line(ln)
+		}
+	}
+	c.nLF, c.nLFQ = 0, c.quotes
+}
+
+// wrapWords wraps `s` at spaces into lines of at most `width` runes, where
+// possible.  Words longer than `width` (e.g. URLs) are not broken.
+func wrapWords(s string, width int) []string {
+	if width < 20 {
+		width = 20
+	}
+	var ret []string
+	var ln strings.Builder
+	nLn := 0
+	for _, w := range strings.Split(s, " ") {
+		if len(w) == 0 {
+			continue
+		}
+		nW := utf8.RuneCountInString(w)
+		if (nLn > 0) && (nLn+1+nW > width) {
+			ret = append(ret, ln.String())
+			ln.Reset()
+			nLn = 0
+		}
+		if nLn > 0 {
+			ln.WriteByte(' ')
+			nLn++
+		}
+		ln.WriteString(w)
+		nLn += nW
+	}
+	if nLn > 0 {
+		ret = append(ret, ln.String())
+	}
+	return ret
+}
+
+// String finishes the conversion, appending link footnotes.
+func (c *htmlText) String() string {
+	c.head, c.bPre, c.quotes, c.lists = 0, false, 0, nil
+	c.flush()
+	if len(c.links) > 0 {
+		c.newlines(2)
+		for ix, href := range c.links {
+			c.emit("["+strconv.Itoa(ix+1)+"] "+href, true)
+		}
+	}
+	if c.out.Len() == 0 {
+		return ""
+	}
+	return c.out.String() + "\n"
+}
@@ -0,0 +1,399 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+/*
+MIMENode is a single MIME entity, as parsed by ParseMIMETree.
+
+Multipart entities (multipart/mixed, multipart/alternative,
+multipart/related, etc.) keep their sub-entities in Children, and have an empty
+Body.  All other entities have no Children, and keep their content in Body,
+decoded according to their Content-Transfer-Encoding.
+*/
+type MIMENode struct {
+	Header   textproto.MIMEHeader
+	Body     []byte
+	Children []*MIMENode
+}
+
+/*
+ParseOptions limits the resources spent parsing a MIME message, to guard
+against hostile input.  A limit of zero (or less) is unlimited.
+
+Parsing functions not called through a ParseOptions use DefaultParseOptions.
+
+MaxHeaderBytes is enforced as each header block is read, including those of
+nested parts, so that an oversized header is never buffered whole.
+*/
+type ParseOptions struct {
+	MaxDepth       int   // maximum nesting depth of multipart entities
+	MaxParts       int   // maximum number of MIME entities, multipart or otherwise
+	MaxBytes       int64 // maximum total size of decoded part bodies
+	MaxHeaderBytes int64 // maximum size of any single header block
+}
+
+// DefaultParseOptions bounds the structure of parsed messages, but not their size.
+var DefaultParseOptions = ParseOptions{
+	MaxDepth: 32,
+	MaxParts: 10000,
+}
+
+// mimeParser tracks the resources spent while parsing a single message.
+type mimeParser struct {
+	ParseOptions
+	nParts int
+	nBytes int64
+}
+
+/*
+NewMIMETreeFromReader reads an RFC 5322 message from an io.Reader and returns
+its MIME structure as a tree.  The root MIMENode's Header holds the message
+headers.
+*/
+func NewMIMETreeFromReader(r io.Reader) (*MIMENode, error) {
+	return DefaultParseOptions.NewMIMETreeFromReader(r)
+}
+
+// NewMIMETreeFromReader is NewMIMETreeFromReader, bounded by `opt`.
+func (opt ParseOptions) NewMIMETreeFromReader(r io.Reader) (*MIMENode, error) {
+	hdrs, body, err := opt.readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return opt.ParseMIMETree(body, hdrs)
+}
+
+/*
+ParseMIMETree will recursively walk a MIME entity and return it as a tree of
+MIMENodes, preserving the nesting that ParseMIMEParts flattens away.
+*/
+func ParseMIMETree(iRdr io.Reader, mHdr textproto.MIMEHeader) (*MIMENode, error) {
+	return DefaultParseOptions.ParseMIMETree(iRdr, mHdr)
+}
+
+// ParseMIMETree is ParseMIMETree, bounded by `opt`.
+func (opt ParseOptions) ParseMIMETree(iRdr io.Reader, mHdr textproto.MIMEHeader) (*MIMENode, error) {
+	p := mimeParser{ParseOptions: opt}
+	return p.parse(iRdr, mHdr, 0)
+}
+
+// readHeader reads the header block at the start of a message, returning the
+// remaining stream as `body`.
+func (opt ParseOptions) readHeader(r io.Reader) (hdrs textproto.MIMEHeader, body *bufio.Reader, err error) {
+
+	body = bufio.NewReader(&trimReader{rd: r})
+	if opt.MaxHeaderBytes <= 0 {
+		hdrs, err = textproto.NewReader(body).ReadMIMEHeader()
+		return
+	}
+
+	// COLLECT LINES UP TO (AND INCLUDING) THE BLANK LINE, WITHIN LIMIT
+	var raw []byte
+	lineStart := 0
+	for {
+		chunk, eR := body.ReadSlice('\n')
+		raw = append(raw, chunk...)
+		if int64(len(raw)) > opt.MaxHeaderBytes {
+			return nil, nil, ErrMaxHeaderBytes
+		}
+		if eR == bufio.ErrBufferFull {
+			continue
+		}
+		if eR == io.EOF {
+			break
+		}
+		if eR != nil {
+			return nil, nil, eR
+		}
+		if len(bytes.TrimRight(raw[lineStart:], "\r\n")) == 0 {
+			break
+		}
+		lineStart = len(raw)
+	}
+
+	hdrs, err = textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	return
+}
+
+func (p *mimeParser) parse(iRdr io.Reader, mHdr textproto.MIMEHeader, depth int) (*MIMENode, error) {
+
+	p.nParts++
+	if (p.MaxParts > 0) && (p.nParts > p.MaxParts) {
+		return nil, ErrMaxParts
+	}
+	if (p.MaxHeaderBytes > 0) && (headerSize(mHdr) > p.MaxHeaderBytes) {
+		return nil, ErrMaxHeaderBytes
+	}
+
+	// If no content type is given, set it to the default
+	if _, ok := mHdr["Content-Type"]; !ok {
+		mHdr.Set("Content-Type", defaultContentType)
+	}
+
+	ct, params, err := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(ct, "multipart/") {
+		body, eB := p.readBody(iRdr, mHdr)
+		if eB != nil {
+			return nil, eB
+		}
+		return &MIMENode{Header: mHdr, Body: body}, nil
+	}
+
+	if (p.MaxDepth > 0) && (depth >= p.MaxDepth) {
+		return nil, ErrMaxDepth
+	}
+	if _, ok := params["boundary"]; !ok {
+		return nil, ErrMissingBoundary
+	}
+
+	pNode := &MIMENode{Header: mHdr}
+	if p.MaxHeaderBytes > 0 {
+		iRdr = &headerLimiter{rd: iRdr, delim: []byte("--" + params["boundary"]), max: p.MaxHeaderBytes}
+	}
+	mr := multipart.NewReader(iRdr, params["boundary"])
+	for {
+		// NOTE: raw parts keep their Content-Transfer-Encoding header, so that
+		// nodes can be re-serialized with the same encodings
+		pPart, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrMaxHeaderBytes) {
+			return pNode, ErrMaxHeaderBytes
+		} else if err != nil {
+			return pNode, err
+		}
+		pChild, err := p.parse(pPart, pPart.Header, depth+1)
+		if errors.Is(err, ErrMaxHeaderBytes) {
+			return pNode, ErrMaxHeaderBytes
+		} else if err != nil {
+			return pNode, err
+		}
+		pNode.Children = append(pNode.Children, pChild)
+	}
+
+	return pNode, nil
+}
+
+/*
+headerLimiter enforces MaxHeaderBytes on the header blocks of a multipart
+body's parts as the body is read, since mime/multipart only returns a part's
+header once it has buffered all of it.  A header block begins after a
+delimiter line, and ends at the first blank line.
+*/
+type headerLimiter struct {
+	rd      io.Reader
+	delim   []byte // "--" + boundary
+	max     int64
+	line    []byte // start of the current line, long enough to match `delim` & then some
+	lineLen int    // length of the current line
+	bHeader bool   // within a header block
+	n       int64  // size of the current header block
+	err     error
+}
+
+func (hl *headerLimiter) Read(buf []byte) (int, error) {
+
+	if hl.err != nil {
+		return 0, hl.err
+	}
+	n, err := hl.rd.Read(buf)
+	for _, c := range buf[:n] {
+		if hl.bHeader {
+			if hl.n++; hl.n > hl.max {
+				hl.err = ErrMaxHeaderBytes
+				return 0, hl.err
+			}
+		}
+		if len(hl.line) < len(hl.delim)+2 {
+			hl.line = append(hl.line, c)
+		}
+		hl.lineLen++
+		if c != '\n' {
+			continue
+		}
+		if hl.bHeader {
+			hl.bHeader = (hl.lineLen > 2) || ((hl.lineLen == 2) && (hl.line[0] != '\r'))
+		} else if bytes.HasPrefix(hl.line, hl.delim) && (len(bytes.Trim(hl.line[len(hl.delim):], " \t\r\n")) == 0) {
+			hl.bHeader, hl.n = true, 0
+		}
+		hl.line, hl.lineLen = hl.line[:0], 0
+	}
+	return n, err
+}
+
+// readBody decodes a leaf entity's body, counting it against MaxBytes.
+func (p *mimeParser) readBody(iRdr io.Reader, mHdr textproto.MIMEHeader) ([]byte, error) {
+
+	iRdr = decodeTransfer(iRdr, mHdr.Get("Content-Transfer-Encoding"))
+	if p.MaxBytes > 0 {
+		iRdr = io.LimitReader(iRdr, p.MaxBytes-p.nBytes+1)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, iRdr)
+	if err != nil {
+		return nil, err
+	}
+	p.nBytes += n
+	if (p.MaxBytes > 0) && (p.nBytes > p.MaxBytes) {
+		return nil, ErrMaxBytes
+	}
+	return buf.Bytes(), nil
+}
+
+// headerSize approximates the wire size of a header block.
+func headerSize(mHdr textproto.MIMEHeader) (n int64) {
+	for k, vals := range mHdr {
+		for _, v := range vals {
+			n += int64(len(k) + len(": ") + len(v) + len("\r\n"))
+		}
+	}
+	return
+}
+
+// MediaType returns the node's parsed Content-Type.
+func (n *MIMENode) MediaType() (string, map[string]string) {
+	ct, params, err := mime.ParseMediaType(n.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil
+	}
+	return ct, params
+}
+
+// IsMultipart reports whether the node is a multipart/* entity.
+func (n *MIMENode) IsMultipart() bool {
+	ct, _ := n.MediaType()
+	return strings.HasPrefix(ct, "multipart/")
+}
+
+/*
+Walk calls fn for the node and each of its descendants, depth-first, in
+document order.  `depth` is 0 for the node Walk was called on.  Walking stops at
+the first non-nil error returned by fn, which is then returned by Walk.
+*/
+func (n *MIMENode) Walk(fn func(pNode *MIMENode, depth int) error) error {
+	return n.walk(fn, 0)
+}
+
+func (n *MIMENode) walk(fn func(pNode *MIMENode, depth int) error, depth int) error {
+	if err := fn(n, depth); err != nil {
+		return err
+	}
+	for _, pChild := range n.Children {
+		if err := pChild.walk(fn, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+FindByContentID returns the first node whose Content-ID matches `cid`, or nil
+if none does.  `cid` may be given bare, in angle brackets, or as a `cid:` URL
+taken from an HTML body.
+*/
+func (n *MIMENode) FindByContentID(cid string) *MIMENode {
+	cid = trimContentID(strings.TrimPrefix(cid, "cid:"))
+	var pFound *MIMENode
+	n.Walk(func(pNode *MIMENode, _ int) error {
+		if trimContentID(pNode.Header.Get("Content-ID")) == cid {
+			pFound = pNode
+			return io.EOF
+		}
+		return nil
+	})
+	return pFound
+}
+
+func trimContentID(cid string) string {
+	cid = strings.TrimSpace(cid)
+	return strings.TrimSuffix(strings.TrimPrefix(cid, "<"), ">")
+}
+
+// Bytes re-serializes the node, including its headers, as a MIME entity (see
+// WriteTo).
+func (n *MIMENode) Bytes() ([]byte, error) {
+	var buff bytes.Buffer
+	if _, err := n.WriteTo(&buff); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+/*
+WriteTo re-serializes the node, including its headers, as a MIME entity.  Leaf
+bodies are re-encoded according to their Content-Transfer-Encoding, and
+multipart entities reuse the boundary given in their Content-Type.
+
+The result is equivalent to the entity that was parsed, but not byte for byte
+the same: the root's header is written as Email headers are (encoded, folded,
+reordered, with a default Content-Type), children's header fields are sorted,
+and bodies are re-wrapped.  Signatures over the original (e.g. DKIM-Signature,
+or S/MIME multipart/signed) will not verify against it; keep the raw message
+for those.
+*/
+func (n *MIMENode) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	headerToBytes(cw, n.Header)
+	io.WriteString(cw, "\r\n")
+	if cw.err == nil {
+		n.writeBody(cw)
+	}
+	return cw.n, cw.err
+}
+
+func (n *MIMENode) writeBody(cw *countWriter) {
+
+	ct, params := n.MediaType()
+
+	if !strings.HasPrefix(ct, "multipart/") {
+		switch strings.ToLower(strings.TrimSpace(n.Header.Get("Content-Transfer-Encoding"))) {
+		case "base64":
+			base64Wrap(cw, n.Body)
+		case "quoted-printable":
+			qp := quotedprintable.NewWriter(cw)
+			qp.Binary = !strings.HasPrefix(ct, "text/")
+			qp.Write(n.Body)
+			qp.Close()
+		default:
+			cw.Write(n.Body)
+		}
+		return
+	}
+
+	if _, ok := params["boundary"]; !ok {
+		cw.err = ErrMissingBoundary
+		return
+	}
+	mw := multipart.NewWriter(cw)
+	if err := mw.SetBoundary(params["boundary"]); err != nil {
+		cw.err = err
+		return
+	}
+	for _, pChild := range n.Children {
+		if _, err := mw.CreatePart(pChild.Header); err != nil {
+			cw.err = err
+			return
+		}
+		pChild.writeBody(cw)
+		if cw.err != nil {
+			return
+		}
+	}
+	mw.Close()
+}
@@ -0,0 +1,217 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+/*
+PGPSigner makes detached OpenPGP signatures, e.g. with an adapter around
+golang.org/x/crypto/openpgp or github.com/ProtonMail/go-crypto.
+*/
+type PGPSigner interface {
+	// DetachSign returns an ASCII-armored, detached signature over `data`, and
+	// the name of the hash algorithm used (e.g. "sha256").
+	DetachSign(data []byte) (sig []byte, hash string, err error)
+}
+
+// PGPEncrypter encrypts data to a message's OpenPGP recipients.
+type PGPEncrypter interface {
+	// Encrypt returns `data` as an ASCII-armored OpenPGP message.
+	Encrypt(data []byte) ([]byte, error)
+}
+
+// PGPVerifier checks detached OpenPGP signatures.
+type PGPVerifier interface {
+	// VerifyDetached checks `sig` (usually ASCII-armored) over `data`, and
+	// returns an identifier for the signer (e.g. key ID or user ID).
+	VerifyDetached(data, sig []byte) (signer string, err error)
+}
+
+// PGPDecrypter decrypts OpenPGP messages.
+type PGPDecrypter interface {
+	// Decrypt returns the plaintext of a (usually ASCII-armored) OpenPGP message.
+	Decrypt(msg []byte) ([]byte, error)
+}
+
+/*
+OpenPGP signs and/or encrypts an Email, per RFC 3156 (OpenPGP/MIME).  Set
+Email.OpenPGP, and Bytes(), WriteTo() and Client.Send will emit the protected
+message.
+
+This package handles the MIME framing only: the cryptography is left to
+Signer & Encrypter.  If Signer is set, the message is signed
+(multipart/signed, with a detached application/pgp-signature).  If Encrypter
+is set, the message (signed first, if applicable) is then encrypted
+(multipart/encrypted).
+*/
+type OpenPGP struct {
+	Signer    PGPSigner    // (optional)
+	Encrypter PGPEncrypter // (optional)
+}
+
+// wrap protects a rendered MIME entity (see entityWrapper).
+func (p *OpenPGP) wrap(entity []byte) (textproto.MIMEHeader, []byte, error) {
+
+	if (p.Signer == nil) && (p.Encrypter == nil) {
+		return nil, nil, ErrInvalidOpenPGP
+	}
+
+	var (
+		mHdr textproto.MIMEHeader
+		body = entity
+		err  error
+	)
+	if p.Signer != nil {
+		// NOTE: entities from writeEntity are already 7-bit, with CRLF line
+		// endings, as RFC 3156 requires of signed content
+		sig, hash, eS := p.Signer.DetachSign(entity)
+		if eS != nil {
+			return nil, nil, eS
+		}
+		mHdr, body, err = signedEntity(entity, "application/pgp-signature", "pgp-"+strings.ToLower(hash), textproto.MIMEHeader{
+			"Content-Type":        {`application/pgp-signature; name="signature.asc"`},
+			"Content-Description": {"OpenPGP digital signature"},
+			"Content-Disposition": {`attachment; filename="signature.asc"`},
+		}, toCRLF(sig))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.Encrypter == nil {
+		return mHdr, body, nil
+	}
+
+	// ENCRYPT THE SIGNED ENTITY, HEADERS INCLUDED
+	if mHdr != nil {
+		entity = entityBytes(mHdr, body)
+	}
+	armored, err := p.Encrypter.Encrypt(entity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	ap, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	io.WriteString(ap, "Version: 1\r\n")
+	ap, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	ap.Write(toCRLF(armored))
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	mHdr = textproto.MIMEHeader{
+		"Content-Type": {"multipart/encrypted; protocol=\"application/pgp-encrypted\";" +
+			"\r\n boundary=" + mw.Boundary()},
+	}
+	return mHdr, buf.Bytes(), nil
+}
+
+/*
+IsOpenPGPSigned reports whether a message or entity header (e.g. Email.Headers
+from NewEmailFromReader, or MIMENode.Header) marks an OpenPGP/MIME signed
+entity.
+*/
+func IsOpenPGPSigned(mHdr textproto.MIMEHeader) bool {
+	ct, params, err := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	return (err == nil) && (ct == "multipart/signed") && strings.EqualFold(params["protocol"], "application/pgp-signature")
+}
+
+// IsOpenPGPEncrypted is IsOpenPGPSigned, for OpenPGP/MIME encrypted entities.
+func IsOpenPGPEncrypted(mHdr textproto.MIMEHeader) bool {
+	ct, params, err := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	return (err == nil) && (ct == "multipart/encrypted") && strings.EqualFold(params["protocol"], "application/pgp-encrypted")
+}
+
+/*
+VerifyOpenPGP checks the signature of a raw, OpenPGP/MIME signed RFC 5322
+message with `v`.  It returns the signer reported by `v`, and the message as it
+was before signing, ready for NewEmailFromReader.
+*/
+func VerifyOpenPGP(msg []byte, v PGPVerifier) (string, []byte, error) {
+
+	sHdrs, mHdr, body, err := splitRawMessage(msg)
+	if err != nil {
+		return "", nil, err
+	}
+	if !IsOpenPGPSigned(mHdr) {
+		return "", nil, ErrOpenPGPNotSigned
+	}
+	_, params, _ := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	entity, sigType, sig, err := splitSigned(body, params["boundary"])
+	if err != nil {
+		return "", nil, err
+	}
+	if sigType != "application/pgp-signature" {
+		return "", nil, ErrOpenPGPNotSigned
+	}
+
+	signer, err := v.VerifyDetached(entity, sig)
+	if err != nil {
+		return "", nil, err
+	}
+	return signer, unwrapEntity(sHdrs, entity), nil
+}
+
+/*
+DecryptOpenPGP opens a raw, OpenPGP/MIME encrypted RFC 5322 message with `d`.
+It returns the decrypted message, ready for NewEmailFromReader, or for
+VerifyOpenPGP if it was also signed.
+*/
+func DecryptOpenPGP(msg []byte, d PGPDecrypter) ([]byte, error) {
+
+	sHdrs, mHdr, body, err := splitRawMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !IsOpenPGPEncrypted(mHdr) {
+		return nil, ErrOpenPGPNotEncrypted
+	}
+	_, params, _ := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	if len(params["boundary"]) == 0 {
+		return nil, ErrMissingBoundary
+	}
+
+	// CONTROL PART, THEN THE ENCRYPTED MESSAGE
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var armored []byte
+	for iPart := 0; iPart < 2; iPart++ {
+		pPart, err := mr.NextRawPart()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(decodeTransfer(pPart, pPart.Header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			return nil, err
+		}
+		ct, _, _ := mime.ParseMediaType(pPart.Header.Get("Content-Type"))
+		if (iPart == 0) && ((ct != "application/pgp-encrypted") || !bytes.Contains(content, []byte("Version: 1"))) {
+			return nil, ErrOpenPGPNotEncrypted
+		}
+		armored = content
+	}
+
+	plain, err := d.Decrypt(armored)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapEntity(sHdrs, toCRLF(plain)), nil
+}
@@ -0,0 +1,137 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+/*
+entityWrapper protects the rendered content entity of an Email (its bodies and
+attachments, with their Content-* headers), returning the Content-* headers and
+body of the entity that replaces it.  See SMIME and OpenPGP.
+*/
+type entityWrapper interface {
+	wrap(entity []byte) (textproto.MIMEHeader, []byte, error)
+}
+
+// entityBytes renders Content-* headers `mHdr` and `body` as a single MIME entity.
+func entityBytes(mHdr textproto.MIMEHeader, body []byte) []byte {
+	var buf bytes.Buffer
+	headerToBytes(&buf, mHdr)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+/*
+signedEntity renders a multipart/signed entity (RFC 1847), with `entity` as
+its first part, written verbatim, followed by the signature part.
+*/
+func signedEntity(entity []byte, protocol, micalg string, sigHdr textproto.MIMEHeader, sig []byte) (textproto.MIMEHeader, []byte, error) {
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	buf.WriteString("--" + mw.Boundary() + "\r\n")
+	buf.Write(entity)
+	buf.WriteString("\r\n")
+	ap, err := mw.CreatePart(sigHdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ap.Write(sig)
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	mHdr := textproto.MIMEHeader{
+		"Content-Type": {"multipart/signed; protocol=\"" + protocol + "\"; micalg=" + micalg + ";" +
+			"\r\n boundary=" + mw.Boundary()},
+	}
+	return mHdr, buf.Bytes(), nil
+}
+
+// splitRawMessage splits a raw message into its raw header fields, parsed
+// header, and body, converting bare LF line endings to CRLF along the way.
+func splitRawMessage(msg []byte) ([]string, textproto.MIMEHeader, []byte, error) {
+	sHdrs, body := splitMessage(toCRLF(msg))
+	mHdr, err := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.Join(sHdrs, "") + "\r\n"))).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return sHdrs, mHdr, body, nil
+}
+
+/*
+splitSigned returns the signed entity of a multipart/signed body, verbatim, as
+well as the media type and decoded content of its signature part.
+*/
+func splitSigned(body []byte, boundary string) (entity []byte, sigType string, sig []byte, err error) {
+
+	if len(boundary) == 0 {
+		return nil, "", nil, ErrMissingBoundary
+	}
+	delim := []byte("--" + boundary)
+
+	// FIRST PART BEGINS AFTER THE FIRST DELIMITER LINE, AND ENDS AT THE CRLF BEFORE THE NEXT
+	ix := bytes.Index(body, delim)
+	for (ix > 0) && (body[ix-1] != '\n') {
+		ixNext := bytes.Index(body[ix+1:], delim)
+		if ixNext < 0 {
+			ix = -1
+			break
+		}
+		ix += 1 + ixNext
+	}
+	if ix < 0 {
+		return nil, "", nil, ErrMissingBoundary
+	}
+	ixStart := bytes.Index(body[ix:], []byte("\r\n"))
+	if ixStart < 0 {
+		return nil, "", nil, ErrMissingBoundary
+	}
+	ixStart += ix + 2
+	ixEnd := bytes.Index(body[ixStart:], append([]byte("\r\n"), delim...))
+	if ixEnd < 0 {
+		return nil, "", nil, ErrMissingBoundary
+	}
+	entity = body[ixStart : ixStart+ixEnd]
+
+	// SECOND PART IS THE SIGNATURE
+	mr := multipart.NewReader(bytes.NewReader(body[ixStart+ixEnd:]), boundary)
+	pPart, err := mr.NextRawPart()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	sigType, _, _ = mime.ParseMediaType(pPart.Header.Get("Content-Type"))
+	if sig, err = io.ReadAll(decodeTransfer(pPart, pPart.Header.Get("Content-Transfer-Encoding"))); err != nil {
+		return nil, "", nil, err
+	}
+	return entity, sigType, sig, nil
+}
+
+// unwrapEntity replaces the Content-* fields of a message's raw header with
+// the unwrapped `entity`.
+func unwrapEntity(sHdrs []string, entity []byte) []byte {
+	var buf bytes.Buffer
+	for _, hdr := range sHdrs {
+		if !strings.HasPrefix(strings.ToLower(headerName(hdr)), "content-") {
+			buf.WriteString(hdr)
+		}
+	}
+	buf.Write(entity)
+	return buf.Bytes()
+}
+
+// toCRLF converts bare LF line endings to CRLF.
+func toCRLF(b []byte) []byte {
+	if bytes.Count(b, []byte("\n")) == bytes.Count(b, []byte("\r\n")) {
+		return b
+	}
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
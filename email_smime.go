@@ -0,0 +1,805 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"mime"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+SMIME signs and/or encrypts an Email, per RFC 8551.  Set Email.SMIME, and
+Bytes(), WriteTo() and Client.Send will emit the protected message.
+
+If Certificate & Key are set, the message is signed (multipart/signed, with a
+detached application/pkcs7-signature).  If Recipients are set, the message
+(signed first, if applicable) is then encrypted to each of them
+(application/pkcs7-mime enveloped-data, AES-256-CBC).  Remember to include the
+sender's own certificate in Recipients, if the sender should be able to read
+the sent copy.
+
+Certificate & Key are also used by Decrypt, to open messages addressed to
+them.
+*/
+type SMIME struct {
+	Certificate *x509.Certificate   // signer's certificate
+	Key         crypto.Signer       // signer's *rsa.PrivateKey or *ecdsa.PrivateKey
+	Chain       []*x509.Certificate // intermediate certificates sent along with signatures (optional)
+	Recipients  []*x509.Certificate // encrypt to these RSA certificates (optional)
+}
+
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidRSA               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidAES128CBC         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC        = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// PKCS #7 / CMS structures (RFC 5652), as much of them as S/MIME needs.
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version            int
+	SID                asn1.RawValue // IssuerAndSerialNumber, or [0] SubjectKeyIdentifier
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue // SET OF
+}
+
+type pkcs7EnvelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo pkcs7EncryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7KeyTransRecipient struct {
+	Version                int
+	RID                    asn1.RawValue // IssuerAndSerialNumber, or [0] SubjectKeyIdentifier
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// wrap protects a rendered MIME entity, returning the Content-* headers and
+// body of the entity that replaces it.
+func (s *SMIME) wrap(entity []byte) (textproto.MIMEHeader, []byte, error) {
+
+	bSign := (s.Certificate != nil) || (s.Key != nil)
+	if !bSign && (len(s.Recipients) == 0) {
+		return nil, nil, ErrInvalidSMIME
+	}
+
+	var (
+		mHdr textproto.MIMEHeader
+		body = entity
+		err  error
+	)
+	if bSign {
+		if mHdr, body, err = s.sign(entity); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(s.Recipients) == 0 {
+		return mHdr, body, nil
+	}
+
+	// ENCRYPT THE SIGNED ENTITY, HEADERS INCLUDED
+	if mHdr != nil {
+		entity = entityBytes(mHdr, body)
+	}
+	return s.encrypt(entity)
+}
+
+// sign renders `entity` as a multipart/signed entity.
+func (s *SMIME) sign(entity []byte) (textproto.MIMEHeader, []byte, error) {
+
+	if (s.Certificate == nil) || (s.Key == nil) {
+		return nil, nil, ErrInvalidSMIME
+	}
+	var sigAlgo pkix.AlgorithmIdentifier
+	switch s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlgo = pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlgo = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, nil, ErrInvalidSMIME
+	}
+
+	// SIGNED ATTRIBUTES, IN DER SET ORDER
+	digest := sha256.Sum256(entity)
+	var sAttrs [][]byte
+	for _, attr := range []struct {
+		oid asn1.ObjectIdentifier
+		val interface{}
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrSigningTime, time.Now().UTC()},
+		{oidAttrMessageDigest, digest[:]},
+	} {
+		val, err := asn1.Marshal(attr.val)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := asn1.Marshal(pkcs7Attribute{
+			Type:   attr.oid,
+			Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: val},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		sAttrs = append(sAttrs, der)
+	}
+	sort.Slice(sAttrs, func(i, j int) bool { return bytes.Compare(sAttrs[i], sAttrs[j]) < 0 })
+	attrs := bytes.Join(sAttrs, nil)
+
+	// THE SIGNATURE COVERS THE ATTRIBUTES, RE-TAGGED AS A SET
+	toSign, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, nil, err
+	}
+	hashed := sha256.Sum256(toSign)
+	sig, err := s.Key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sid, err := issuerAndSerial(s.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	var certs []byte
+	for _, pCert := range append([]*x509.Certificate{s.Certificate}, s.Chain...) {
+		certs = append(certs, pCert.Raw...)
+	}
+	sha256Algo := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algo},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    sha256Algo,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: sigAlgo,
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	p7s, err := contentInfo(oidSignedData, sd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var b64 bytes.Buffer
+	base64Wrap(&b64, p7s)
+	return signedEntity(entity, "application/pkcs7-signature", "sha-256", textproto.MIMEHeader{
+		"Content-Type":              {`application/pkcs7-signature; name="smime.p7s"`},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {`attachment; filename="smime.p7s"`},
+		"Content-Description":       {"S/MIME Cryptographic Signature"},
+	}, b64.Bytes())
+}
+
+// encrypt renders `entity` as an application/pkcs7-mime enveloped-data entity.
+func (s *SMIME) encrypt(entity []byte) (textproto.MIMEHeader, []byte, error) {
+
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, nil, err
+	}
+
+	// RECIPIENTS EACH GET THE CONTENT KEY, ENCRYPTED TO THEIR RSA KEYS
+	var sRecips []asn1.RawValue
+	for _, pCert := range s.Recipients {
+		pub, ok := pCert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, nil, ErrInvalidSMIME
+		}
+		encKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		rid, err := issuerAndSerial(pCert)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := asn1.Marshal(pkcs7KeyTransRecipient{
+			RID:                    asn1.RawValue{FullBytes: rid},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encKey,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		sRecips = append(sRecips, asn1.RawValue{FullBytes: der})
+	}
+
+	// AES-256-CBC, PKCS #7 PADDED
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nPad := aes.BlockSize - len(entity)%aes.BlockSize
+	ct := append(append([]byte{}, entity...), bytes.Repeat([]byte{byte(nPad)}, nPad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ct, ct)
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, nil, err
+	}
+	ed, err := asn1.Marshal(pkcs7EnvelopedData{
+		RecipientInfos: sRecips,
+		EncryptedContentInfo: pkcs7EncryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ct},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	p7m, err := contentInfo(oidEnvelopedData, ed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	base64Wrap(&buf, p7m)
+	mHdr := textproto.MIMEHeader{
+		"Content-Type":              {`application/pkcs7-mime; smime-type=enveloped-data; name="smime.p7m"`},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {`attachment; filename="smime.p7m"`},
+	}
+	return mHdr, buf.Bytes(), nil
+}
+
+// contentInfo wraps DER `content` in a ContentInfo of type `oid`.
+func contentInfo(oid asn1.ObjectIdentifier, content []byte) ([]byte, error) {
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oid,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	})
+}
+
+// issuerAndSerial is the DER IssuerAndSerialNumber identifying `pCert`.
+func issuerAndSerial(pCert *x509.Certificate) ([]byte, error) {
+	return asn1.Marshal(pkcs7IssuerAndSerial{
+		Issuer: asn1.RawValue{FullBytes: pCert.RawIssuer},
+		Serial: pCert.SerialNumber,
+	})
+}
+
+// matchesCert reports whether a SignerIdentifier / RecipientIdentifier names `pCert`.
+func matchesCert(id asn1.RawValue, pCert *x509.Certificate) bool {
+	if (id.Class == asn1.ClassContextSpecific) && (id.Tag == 0) {
+		return (len(pCert.SubjectKeyId) > 0) && bytes.Equal(id.Bytes, pCert.SubjectKeyId)
+	}
+	var ias pkcs7IssuerAndSerial
+	if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil {
+		return false
+	}
+	return bytes.Equal(ias.Issuer.FullBytes, pCert.RawIssuer) && (ias.Serial.Cmp(pCert.SerialNumber) == 0)
+}
+
+/*
+VerifySMIME checks the S/MIME signature of a raw RFC 5322 message, either
+multipart/signed or opaque (application/pkcs7-mime signed-data).  It returns the
+signer's certificate, and the message as it was before signing, ready for
+NewEmailFromReader.
+
+The signer's certificate is verified against `opts`, where a nil opts.Roots
+means the system roots.  Certificates sent along with the signature are used as
+intermediates, and KeyUsages defaults to x509.ExtKeyUsageEmailProtection.
+*/
+func VerifySMIME(msg []byte, opts x509.VerifyOptions) (*x509.Certificate, []byte, error) {
+
+	sHdrs, mHdr, body, err := splitRawMessage(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entity, p7s []byte
+	ct, params, err := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case ct == "multipart/signed":
+		var sigType string
+		if entity, sigType, p7s, err = splitSigned(body, params["boundary"]); err != nil {
+			return nil, nil, err
+		}
+		if (sigType != "application/pkcs7-signature") && (sigType != "application/x-pkcs7-signature") {
+			return nil, nil, ErrSMIMENotSigned
+		}
+	case isPKCS7MIME(ct) && strings.EqualFold(params["smime-type"], "signed-data"):
+		if p7s, err = io.ReadAll(decodeTransfer(bytes.NewReader(body), mHdr.Get("Content-Transfer-Encoding"))); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, ErrSMIMENotSigned
+	}
+
+	var sd pkcs7SignedData
+	if err := parseContentInfo(p7s, oidSignedData, &sd); err != nil {
+		return nil, nil, err
+	}
+	if entity == nil {
+		// OPAQUE SIGNATURES CARRY THE SIGNED ENTITY
+		var eContent asn1.RawValue
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &eContent); err != nil {
+			return nil, nil, ErrSMIMEMalformed
+		}
+		if entity, err = octets(eContent); err != nil {
+			return nil, nil, err
+		}
+		entity = toCRLF(entity)
+	}
+
+	sCerts, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, nil, ErrSMIMEMalformed
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, nil, ErrSMIMENotSigned
+	}
+
+	// EVERY SIGNER MUST VERIFY; THE FIRST IS REPORTED
+	var pSigner *x509.Certificate
+	for _, si := range sd.SignerInfos {
+		var pCert *x509.Certificate
+		for _, pC := range sCerts {
+			if matchesCert(si.SID, pC) {
+				pCert = pC
+				break
+			}
+		}
+		if pCert == nil {
+			return nil, nil, ErrSMIMEMalformed
+		}
+		if err := verifySignerInfo(si, pCert, sd.ContentInfo.ContentType, entity); err != nil {
+			return nil, nil, err
+		}
+		if pSigner == nil {
+			pSigner = pCert
+		}
+	}
+
+	if opts.Intermediates == nil {
+		opts.Intermediates = x509.NewCertPool()
+	}
+	for _, pC := range sCerts {
+		opts.Intermediates.AddCert(pC)
+	}
+	if len(opts.KeyUsages) == 0 {
+		opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	}
+	if _, err := pSigner.Verify(opts); err != nil {
+		return nil, nil, err
+	}
+
+	return pSigner, unwrapEntity(sHdrs, entity), nil
+}
+
+// verifySignerInfo checks one signature over `entity`, of content type `oidType`.
+func verifySignerInfo(si pkcs7SignerInfo, pCert *x509.Certificate, oidType asn1.ObjectIdentifier, entity []byte) error {
+
+	var hash crypto.Hash
+	switch {
+	case si.DigestAlgorithm.Algorithm.Equal(oidSHA1):
+		hash = crypto.SHA1
+	case si.DigestAlgorithm.Algorithm.Equal(oidSHA256):
+		hash = crypto.SHA256
+	case si.DigestAlgorithm.Algorithm.Equal(oidSHA384):
+		hash = crypto.SHA384
+	case si.DigestAlgorithm.Algorithm.Equal(oidSHA512):
+		hash = crypto.SHA512
+	default:
+		return ErrSMIMEUnsupported
+	}
+	h := newHash(hash)
+	h.Write(entity)
+	digest := h.Sum(nil)
+
+	// WITH SIGNED ATTRIBUTES, THE SIGNATURE COVERS THEM, AND THEY COVER THE CONTENT
+	if len(si.SignedAttrs.Bytes) > 0 {
+		bDigest, bType := false, false
+		for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+			var attr pkcs7Attribute
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+				return ErrSMIMEMalformed
+			}
+			if attr.Type.Equal(oidAttrMessageDigest) {
+				var md []byte
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &md); err != nil {
+					return ErrSMIMEMalformed
+				}
+				if !bytes.Equal(md, digest) {
+					return ErrSMIMESignature
+				}
+				bDigest = true
+			} else if attr.Type.Equal(oidAttrContentType) {
+				// RFC 5652 11.1: MUST MATCH THE SIGNED CONTENT TYPE
+				var oid asn1.ObjectIdentifier
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &oid); err != nil {
+					return ErrSMIMEMalformed
+				}
+				if !oid.Equal(oidType) {
+					return ErrSMIMESignature
+				}
+				bType = true
+			}
+		}
+		if !bDigest || !bType {
+			return ErrSMIMEMalformed
+		}
+		toSign, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+		if err != nil {
+			return err
+		}
+		h = newHash(hash)
+		h.Write(toSign)
+		digest = h.Sum(nil)
+	}
+
+	switch pub := pCert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, hash, digest, si.Signature) != nil {
+			return ErrSMIMESignature
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, si.Signature) {
+			return ErrSMIMESignature
+		}
+	default:
+		return ErrSMIMEUnsupported
+	}
+	return nil
+}
+
+func newHash(hash crypto.Hash) interface {
+	io.Writer
+	Sum([]byte) []byte
+} {
+	switch hash {
+	case crypto.SHA1:
+		return sha1.New()
+	case crypto.SHA384:
+		return sha512.New384()
+	case crypto.SHA512:
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+/*
+Decrypt opens a raw RFC 5322 message encrypted with S/MIME (application/pkcs7-mime
+enveloped-data) to s.Certificate, using s.Key, which must be an
+*rsa.PrivateKey (or other crypto.Decrypter).  It returns the decrypted message,
+ready for NewEmailFromReader, or for VerifySMIME if it was also signed.
+
+Once our copy of the content key is found, any failure to decrypt returns
+ErrSMIMEDecrypt, so that failures of the key and of the content cannot be told
+apart.
+*/
+func (s *SMIME) Decrypt(msg []byte) ([]byte, error) {
+
+	dec, ok := s.Key.(crypto.Decrypter)
+	if (s.Certificate == nil) || !ok {
+		return nil, ErrInvalidSMIME
+	}
+
+	sHdrs, mHdr, body, err := splitRawMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	ct, params, err := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if !isPKCS7MIME(ct) || ((len(params["smime-type"]) > 0) && !strings.EqualFold(params["smime-type"], "enveloped-data")) {
+		return nil, ErrSMIMENotEncrypted
+	}
+	p7m, err := io.ReadAll(decodeTransfer(bytes.NewReader(body), mHdr.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return nil, err
+	}
+
+	var ed pkcs7EnvelopedData
+	if err := parseContentInfo(p7m, oidEnvelopedData, &ed); err != nil {
+		return nil, err
+	}
+
+	// CONTENT ALGORITHM, IV & CIPHERTEXT
+	eci := ed.EncryptedContentInfo
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch alg := eci.ContentEncryptionAlgorithm.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case alg.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case alg.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case alg.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, ErrSMIMEUnsupported
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, ErrSMIMEMalformed
+	}
+	ct2, err := octets(eci.EncryptedContent)
+	if err != nil {
+		return nil, err
+	}
+
+	// FIND OUR COPY OF THE CONTENT KEY
+	// NOTE: with SessionKeyLen, a bad unwrap yields a random key rather than
+	// an error, so that failures cannot be told apart (Bleichenbacher)
+	var key []byte
+	for _, ri := range ed.RecipientInfos {
+		var ktri pkcs7KeyTransRecipient
+		if _, err := asn1.Unmarshal(ri.FullBytes, &ktri); err != nil {
+			// other recipient types (key agreement, etc.)
+			continue
+		}
+		if matchesCert(ktri.RID, s.Certificate) {
+			if !ktri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSA) {
+				return nil, ErrSMIMEUnsupported
+			}
+			if key, err = dec.Decrypt(rand.Reader, ktri.EncryptedKey, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: keyLen}); err != nil {
+				return nil, ErrSMIMEDecrypt
+			}
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrSMIMENoRecipient
+	}
+
+	// FROM HERE ON, EVERY FAILURE IS THE SAME FAILURE
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, ErrSMIMEDecrypt
+	}
+	bs := block.BlockSize()
+	if (len(iv) != bs) || (len(ct2) == 0) || (len(ct2)%bs != 0) {
+		return nil, ErrSMIMEDecrypt
+	}
+	pt := make([]byte, len(ct2))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(pt, ct2)
+
+	// PKCS #7 PADDING, CHECKED IN CONSTANT TIME
+	nPad := int(pt[len(pt)-1])
+	good := subtle.ConstantTimeLessOrEq(1, nPad) & subtle.ConstantTimeLessOrEq(nPad, bs)
+	for ix := 0; ix < bs; ix++ {
+		bPad := subtle.ConstantTimeLessOrEq(ix+1, nPad)
+		good &= subtle.ConstantTimeSelect(bPad, subtle.ConstantTimeByteEq(pt[len(pt)-1-ix], byte(nPad)), 1)
+	}
+	if good != 1 {
+		return nil, ErrSMIMEDecrypt
+	}
+
+	return unwrapEntity(sHdrs, toCRLF(pt[:len(pt)-nPad])), nil
+}
+
+func isPKCS7MIME(ct string) bool {
+	return (ct == "application/pkcs7-mime") || (ct == "application/x-pkcs7-mime")
+}
+
+// parseContentInfo parses a BER ContentInfo of type `oid` into `content`.
+func parseContentInfo(ber []byte, oid asn1.ObjectIdentifier, content interface{}) error {
+	der, err := berToDER(ber)
+	if err != nil {
+		return err
+	}
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return ErrSMIMEMalformed
+	}
+	if !ci.ContentType.Equal(oid) {
+		return ErrSMIMEUnsupported
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, content); err != nil {
+		return ErrSMIMEMalformed
+	}
+	return nil
+}
+
+// octets returns the contents of an OCTET STRING, concatenating the segments
+// of a constructed (BER) one.
+func octets(rv asn1.RawValue) ([]byte, error) {
+	if !rv.IsCompound {
+		return rv.Bytes, nil
+	}
+	var ret []byte
+	for rest := rv.Bytes; len(rest) > 0; {
+		var seg asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &seg); err != nil {
+			return nil, ErrSMIMEMalformed
+		}
+		b, err := octets(seg)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, b...)
+	}
+	return ret, nil
+}
+
+/*
+berToDER re-encodes the indefinite lengths that S/MIME agents commonly emit as
+definite ones, so that encoding/asn1 can parse the result.  Nothing else about
+the encoding is changed.
+*/
+func berToDER(ber []byte) ([]byte, error) {
+	der, _, err := berElement(ber, 0)
+	return der, err
+}
+
+// maxBERDepth bounds the nesting of constructed BER elements
+const maxBERDepth = 64
+
+func berElement(b []byte, depth int) (der, rest []byte, err error) {
+
+	if depth > maxBERDepth {
+		return nil, nil, ErrSMIMEMalformed
+	}
+
+	// TAG
+	ix := 1
+	if (len(b) > 0) && (b[0]&0x1f == 0x1f) {
+		for (ix < len(b)) && (b[ix]&0x80 != 0) {
+			ix++
+		}
+		ix++
+	}
+	if ix >= len(b) {
+		return nil, nil, ErrSMIMEMalformed
+	}
+	tag := b[:ix]
+	bCompound := b[0]&0x20 != 0
+
+	// LENGTH
+	l := int(b[ix])
+	ix++
+	var content []byte
+	if l == 0x80 {
+		if !bCompound {
+			return nil, nil, ErrSMIMEMalformed
+		}
+		rest = b[ix:]
+		for {
+			if len(rest) < 2 {
+				return nil, nil, ErrSMIMEMalformed
+			}
+			if (rest[0] == 0) && (rest[1] == 0) {
+				rest = rest[2:]
+				break
+			}
+			var child []byte
+			if child, rest, err = berElement(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			content = append(content, child...)
+		}
+	} else {
+		if l > 0x80 {
+			nLen := l & 0x7f
+			if (nLen > 4) || (ix+nLen > len(b)) {
+				return nil, nil, ErrSMIMEMalformed
+			}
+			l = 0
+			for _, c := range b[ix : ix+nLen] {
+				l = l<<8 | int(c)
+			}
+			ix += nLen
+		}
+		if (l < 0) || (ix+l > len(b)) {
+			return nil, nil, ErrSMIMEMalformed
+		}
+		content, rest = b[ix:ix+l], b[ix+l:]
+		if bCompound {
+			var children []byte
+			for sub := content; len(sub) > 0; {
+				var child []byte
+				if child, sub, err = berElement(sub, depth+1); err != nil {
+					return nil, nil, err
+				}
+				children = append(children, child...)
+			}
+			content = children
+		}
+	}
+
+	der = append(der, tag...)
+	der = append(der, derLength(len(content))...)
+	der = append(der, content...)
+	return der, rest, nil
+}
+
+func derLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var ret []byte
+	for ; n > 0; n >>= 8 {
+		ret = append([]byte{byte(n)}, ret...)
+	}
+	return append([]byte{0x80 | byte(len(ret))}, ret...)
+}
@@ -0,0 +1,209 @@
+package email
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"net/textproto"
+	texttemplate "text/template"
+)
+
+/*
+Template renders the Subject, Text and HTML of personalized messages for a mail
+merge.  Text and Subject are rendered with text/template, and HTML with
+html/template, so that data substituted into HTML is escaped.
+
+Each template is optional: when nil, the corresponding value from the base
+Email is kept.
+*/
+type Template struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	HTML    *htmltemplate.Template
+}
+
+/*
+NewTemplate parses template sources for the Subject, Text and HTML of a
+message.  Empty sources leave the corresponding template nil.
+
+For custom functions or delimiters, build a Template's fields directly.
+*/
+func NewTemplate(subject, text, html string) (*Template, error) {
+
+	var (
+		t   Template
+		err error
+	)
+	if len(subject) > 0 {
+		if t.Subject, err = texttemplate.New("subject").Parse(subject); err != nil {
+			return nil, err
+		}
+	}
+	if len(text) > 0 {
+		if t.Text, err = texttemplate.New("text").Parse(text); err != nil {
+			return nil, err
+		}
+	}
+	if len(html) > 0 {
+		if t.HTML, err = htmltemplate.New("html").Parse(html); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+/*
+Execute returns a copy of `base` with its Subject, Text and HTML rendered from
+`data`.  Headers are copied, less any Message-Id and Date, so that each message
+gets its own; attachments and other fields are shared with `base`.
+*/
+func (t *Template) Execute(base *Email, data interface{}) (*Email, error) {
+
+	pMsg := *base
+	if base.Headers != nil {
+		pMsg.Headers = make(textproto.MIMEHeader, len(base.Headers))
+		for k, v := range base.Headers {
+			pMsg.Headers[k] = append([]string(nil), v...)
+		}
+		pMsg.Headers.Del("Message-Id")
+		pMsg.Headers.Del("Date")
+	}
+
+	var buf bytes.Buffer
+	if t.Subject != nil {
+		if err := t.Subject.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		pMsg.Subject = buf.String()
+		buf.Reset()
+	}
+	if t.Text != nil {
+		if err := t.Text.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		pMsg.Text = append([]byte(nil), buf.Bytes()...)
+		buf.Reset()
+	}
+	if t.HTML != nil {
+		if err := t.HTML.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		pMsg.HTML = append([]byte(nil), buf.Bytes()...)
+	}
+	return &pMsg, nil
+}
+
+/*
+Recipient is a single record of a mail merge.  Its To, Cc and Bcc replace
+those of the base message (and any To, Cc or Bcc header), so that the base's
+recipients are not sent a copy of every personalized message.
+*/
+type Recipient struct {
+	To   []string
+	Cc   []string
+	Bcc  []string
+	Data interface{} // passed to the Template
+}
+
+/*
+RecipientIterator supplies the records of a mail merge, one at a time, so that
+large lists need not be held in memory.
+*/
+type RecipientIterator interface {
+	// Next returns the next record, or io.EOF when there are no more.
+	Next() (*Recipient, error)
+}
+
+// RecipientIteratorFunc adapts a function to the RecipientIterator interface.
+type RecipientIteratorFunc func() (*Recipient, error)
+
+// Next calls fn().
+func (fn RecipientIteratorFunc) Next() (*Recipient, error) {
+	return fn()
+}
+
+// Recipients iterates over a slice of records.
+func Recipients(sRecips []Recipient) RecipientIterator {
+	ix := 0
+	return RecipientIteratorFunc(func() (*Recipient, error) {
+		if ix >= len(sRecips) {
+			return nil, io.EOF
+		}
+		ix++
+		return &sRecips[ix-1], nil
+	})
+}
+
+/*
+MergeErrorFunc decides what happens when rendering or sending to a Recipient
+fails: return nil to skip the recipient and carry on, or an error to stop the
+merge.
+*/
+type MergeErrorFunc func(pRecip *Recipient, err error) error
+
+/*
+Merge renders a message from `base` and `t` for each record from `iRecips`, and
+sends them in turn over the established SMTP session `pCli`.  It returns the
+number of messages sent, including any sent to only some of their recipients
+(see Client.AllowPartial).  Each message goes only to its Recipient's To, Cc
+and Bcc; those of `base` are not used.
+
+If `fnErr` is nil, the merge stops at the first error.  Otherwise `fnErr`
+decides.  Transactions the server refuses are already reset by
+Client.SendWithResult, but a message that fails partway through DATA leaves
+the session unusable, so the next message then fails, and (unless `fnErr`
+skips every one) ends the merge.
+*/
+func (c *Client) Merge(t *Template, base *Email, iRecips RecipientIterator, fnErr MergeErrorFunc) (int, error) {
+
+	nSent := 0
+	for {
+		pRecip, err := iRecips.Next()
+		if err == io.EOF {
+			return nSent, nil
+		} else if err != nil {
+			return nSent, err
+		}
+
+		pMsg, err := t.Execute(base, pRecip.Data)
+		if err == nil {
+			pMsg.To, pMsg.Cc, pMsg.Bcc = pRecip.To, pRecip.Cc, pRecip.Bcc
+			if pMsg.Headers != nil {
+				pMsg.Headers.Del("To")
+				pMsg.Headers.Del("Cc")
+				pMsg.Headers.Del("Bcc")
+			}
+			_, err = c.SendWithResult(pMsg)
+		}
+		if err == nil {
+			nSent++
+			continue
+		}
+
+		if fnErr == nil {
+			return nSent, err
+		}
+		if err = fnErr(pRecip, err); err != nil {
+			return nSent, err
+		}
+	}
+}
+
+/*
+MergeSend connects to an SMTP server, runs a mail merge (see Client.Merge),
+then disconnects.  It returns the number of messages sent.
+*/
+func (cfg SMTPClientConfig) MergeSend(t *Template, base *Email, iRecips RecipientIterator, fnErr MergeErrorFunc) (int, error) {
+
+	pCli, err := cfg.Dial()
+	if err != nil {
+		return 0, err
+	}
+
+	nSent, err := pCli.Merge(t, base, iRecips, fnErr)
+	if err != nil {
+		pCli.Close()
+		return nSent, err
+	}
+	return nSent, pCli.Quit()
+}
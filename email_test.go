@@ -2,11 +2,15 @@ package email
 
 import (
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 
 	"bytes"
 	"io"
@@ -14,9 +18,19 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
 	"net/mail"
 	"net/textproto"
+	"time"
 )
 
 type testClientCfg struct {
@@ -412,6 +426,28 @@ This is a test message!`)
 	}
 }
 
+func TestTrimReader(t *testing.T) {
+
+	// ONLY THE START OF THE STREAM IS TRIMMED, HOWEVER IT IS READ
+	raw := "\r\n \tFrom: test@test.com\r\nContent-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: binary\r\n\r\n \r\n\x00 \t"
+	got, err := io.ReadAll(&trimReader{rd: iotest.OneByteReader(strings.NewReader(raw))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != strings.TrimLeft(raw, "\r\n \t") {
+		t.Errorf("Unexpected trim: %q", got)
+	}
+
+	pRoot, err := NewMIMETreeFromReader(iotest.OneByteReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pRoot.Body) != " \r\n\x00 \t" {
+		t.Errorf("Binary body altered: %q", pRoot.Body)
+	}
+}
+
 func TestBase64EmailFromReader(t *testing.T) {
 
 	msgExpect := &Email{
@@ -462,6 +498,2064 @@ d-printable decoding.</div>
 	}
 }
 
+func TestAttachmentsFromReader(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported!\n")
+	msgIn.HTML = []byte("<h1>Fancy Html is supported, too!</h1>\n")
+
+	sAttach := []struct {
+		name, ct string
+		content  []byte
+	}{
+		{"rad.txt", "text/plain; charset=utf-8", []byte("Rad attachment")},
+		{"blob.bin", "application/octet-stream", []byte{0, 1, 2, 3, 0xFE, 0xFF}},
+	}
+	for _, at := range sAttach {
+		if _, err := msgIn.Attach(bytes.NewReader(at.content), at.name, at.ct); err != nil {
+			t.Fatal("Could not add an attachment to the message: ", err)
+		}
+	}
+
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	msgRead, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	if len(msgRead.Attachments) != len(sAttach) {
+		t.Fatalf("Expected %d attachments, got %d", len(sAttach), len(msgRead.Attachments))
+	}
+	for ix, at := range sAttach {
+		pAt := msgRead.Attachments[ix]
+		if pAt.Filename != at.name {
+			t.Errorf("Incorrect filename: %#q != %#q", pAt.Filename, at.name)
+		}
+		if !bytes.Equal(pAt.Content, at.content) {
+			t.Errorf("Incorrect content: %#q != %#q", pAt.Content, at.content)
+		}
+		if ct := pAt.Header.Get("Content-Type"); ct != at.ct {
+			t.Errorf("Incorrect Content-Type: %#q != %#q", ct, at.ct)
+		}
+	}
+	if !bytes.Equal(msgRead.Text, []byte("Text Body is, of course, supported!\r\n")) {
+		t.Errorf("Incorrect text: %#q", msgRead.Text)
+	}
+
+	// attachments must survive a second round trip
+	raw, err = msgRead.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	msgRead, err = NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	if len(msgRead.Attachments) != len(sAttach) {
+		t.Fatalf("Expected %d attachments, got %d", len(sAttach), len(msgRead.Attachments))
+	}
+	if !bytes.Equal(msgRead.Attachments[1].Content, sAttach[1].content) {
+		t.Errorf("Incorrect content: %#q != %#q", msgRead.Attachments[1].Content, sAttach[1].content)
+	}
+}
+
+func TestTransferEncodingRoundTrip(t *testing.T) {
+
+	text := []byte("There are some wacky parts like =, and a line long enough that it must be soft-wrapped by the encoder.\r\n" +
+		"Also, we need to support unicode so here's a fish: \U0001F41F\r\n")
+	html := []byte("<div dir=\"ltr\">This is a test email with <b>HTML Formatting.</b>\u00a0It also has very long lines so that the content must be wrapped.</div>")
+
+	for _, tc := range []struct{ text, html []byte }{
+		{text, nil},
+		{nil, html},
+		{text, html},
+	} {
+		msgIn := dummyEmail()
+		msgIn.Text = tc.text
+		msgIn.HTML = tc.html
+
+		raw, err := msgIn.Bytes()
+		if err != nil {
+			t.Fatal("Failed to render message: ", err)
+		}
+		msgRead, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Error creating email %s", err.Error())
+		}
+		if !bytes.Equal(msgRead.Text, tc.text) {
+			t.Errorf("Incorrect text: %#q != %#q", msgRead.Text, tc.text)
+		}
+		if !bytes.Equal(msgRead.HTML, tc.html) {
+			t.Errorf("Incorrect HTML: %#q != %#q", msgRead.HTML, tc.html)
+		}
+	}
+}
+
+func TestDecodeTransferEncodings(t *testing.T) {
+
+	for _, tc := range []struct{ cte, body, want string }{
+		{"Quoted-Printable", "a=3Db =\r\nc", "a=b c"},
+		{"BASE64", "YT1i\r\nIGM=", "a=b c"},
+		{" 7bit ", "a=3Db", "a=3Db"},
+		{"8BIT", "\xc3\xa9", "\xc3\xa9"},
+		{"binary", "\x00\x01", "\x00\x01"},
+	} {
+		mHdr := textproto.MIMEHeader{}
+		mHdr.Set("Content-Type", "text/plain")
+		mHdr.Set("Content-Transfer-Encoding", tc.cte)
+		ps, err := ParseMIMEParts(strings.NewReader(tc.body), mHdr)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.cte, err)
+		}
+		if got := ps[0].Body.String(); got != tc.want {
+			t.Errorf("%s: %#q != %#q", tc.cte, got, tc.want)
+		}
+	}
+}
+
+func TestCharsetEmailFromReader(t *testing.T) {
+
+	raw := []byte("From: test@test.com\r\n" +
+		"To: recipient@test.com\r\n" +
+		"Subject: =?windows-1251?B?z/Do4uXy?=\r\n" +
+		"Content-Type: multipart/alternative; boundary=BOUND\r\n" +
+		"\r\n" +
+		"--BOUND\r\n" +
+		"Content-Type: text/plain; charset=\"ISO-8859-1\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Gr=FC=DFe\r\n" +
+		"--BOUND\r\n" +
+		"Content-Type: text/html; charset=windows-1252\r\n" +
+		"\r\n" +
+		"\x93quoted\x94 \x80\r\n" +
+		"--BOUND--\r\n")
+
+	msgRead, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	if want := "Привет"; msgRead.Subject != want {
+		t.Errorf("Incorrect subject. %#q != %#q", msgRead.Subject, want)
+	}
+	if want := "Grüße"; string(msgRead.Text) != want {
+		t.Errorf("Incorrect text: %#q != %#q", msgRead.Text, want)
+	}
+	if want := "\u201cquoted\u201d \u20ac"; string(msgRead.HTML) != want {
+		t.Errorf("Incorrect HTML: %#q != %#q", msgRead.HTML, want)
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+
+	if _, err := DecodeCharset("x-unknown", []byte("abc")); err != CharsetError("x-unknown") {
+		t.Errorf("expected CharsetError, got %v", err)
+	}
+
+	RegisterCharset("X-Upper", func(src []byte) ([]byte, error) {
+		return bytes.ToUpper(src), nil
+	})
+	dec, err := DecodeCharset("x-upper", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != "ABC" {
+		t.Errorf("registered decoder not used: %#q", dec)
+	}
+
+	// A BODY IN AN UNKNOWN CHARSET IS KEPT AS-IS, WITH ITS CHARSET RECORDED
+	raw := []byte("From: test@test.com\r\n" +
+		"Content-Type: text/plain; charset=x-unknown\r\n" +
+		"\r\n" +
+		"abc\r\n")
+	msgRead, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (string(msgRead.Text) != "abc\r\n") || (msgRead.Charset != "x-unknown") {
+		t.Errorf("Expected undecoded x-unknown text, got %#q in %q", msgRead.Text, msgRead.Charset)
+	}
+	raw = bytes.Replace(raw, []byte("x-unknown"), []byte("x-upper"), 1)
+	if msgRead, err = NewEmailFromReader(bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if (string(msgRead.Text) != "ABC\r\n") || (msgRead.Charset != "") {
+		t.Errorf("Expected decoded text, got %#q in %q", msgRead.Text, msgRead.Charset)
+	}
+}
+
+func TestMIMETree(t *testing.T) {
+
+	raw := []byte("From: test@test.com\r\n" +
+		"To: recipient@test.com\r\n" +
+		"Subject: Tree\r\n" +
+		"Content-Type: multipart/mixed; boundary=MIXED\r\n" +
+		"\r\n" +
+		"--MIXED\r\n" +
+		"Content-Type: multipart/alternative; boundary=ALT\r\n" +
+		"\r\n" +
+		"--ALT\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"a=3Db\r\n" +
+		"--ALT\r\n" +
+		"Content-Type: multipart/related; boundary=REL\r\n" +
+		"\r\n" +
+		"--REL\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"\r\n" +
+		"<img src=\"cid:logo@test\">\r\n" +
+		"--REL\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <logo@test>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--REL--\r\n" +
+		"--ALT--\r\n" +
+		"--MIXED\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"rad.bin\"\r\n" +
+		"\r\n" +
+		"rad\r\n" +
+		"--MIXED--\r\n")
+
+	checkTree := func(pRoot *MIMENode) {
+
+		var sTypes []string
+		pRoot.Walk(func(pNode *MIMENode, depth int) error {
+			ct, _ := pNode.MediaType()
+			sTypes = append(sTypes, fmt.Sprintf("%d:%s", depth, ct))
+			return nil
+		})
+		want := "0:multipart/mixed 1:multipart/alternative 2:text/plain 2:multipart/related 3:text/html 3:image/png 1:application/octet-stream"
+		if got := strings.Join(sTypes, " "); got != want {
+			t.Fatalf("Incorrect tree: %#q != %#q", got, want)
+		}
+
+		pImg := pRoot.FindByContentID("cid:logo@test")
+		if pImg == nil {
+			t.Fatal("Could not find node by Content-ID")
+		}
+		if !bytes.Equal(pImg.Body, []byte("\x89PNG\r\n\x1a\n")) {
+			t.Errorf("Incorrect image body: %#q", pImg.Body)
+		}
+		if pRoot.FindByContentID("<missing@test>") != nil {
+			t.Error("Found node for missing Content-ID")
+		}
+		if txt := pRoot.Children[0].Children[0].Body; string(txt) != "a=b" {
+			t.Errorf("Incorrect text body: %#q", txt)
+		}
+	}
+
+	pRoot, err := NewMIMETreeFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(pRoot)
+
+	// re-serialized tree must parse back to the same structure
+	rawOut, err := pRoot.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pRoot, err = NewMIMETreeFromReader(bytes.NewReader(rawOut))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(pRoot)
+}
+
+func TestParseOptionsLimits(t *testing.T) {
+
+	// nested multipart/mixed, `depth` levels deep, around a single text part
+	nested := func(depth int) []byte {
+		var buf bytes.Buffer
+		buf.WriteString("Subject: Nested\r\n")
+		for ix := 0; ix < depth; ix++ {
+			fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=B%d\r\n\r\n--B%d\r\n", ix, ix)
+		}
+		buf.WriteString("Content-Type: text/plain\r\n\r\nHello, world!\r\n")
+		for ix := depth - 1; ix >= 0; ix-- {
+			fmt.Fprintf(&buf, "--B%d--\r\n", ix)
+		}
+		return buf.Bytes()
+	}
+
+	for _, tc := range []struct {
+		opt  ParseOptions
+		raw  []byte
+		want error
+	}{
+		{ParseOptions{}, nested(40), nil},
+		{ParseOptions{MaxDepth: 3}, nested(3), nil},
+		{ParseOptions{MaxDepth: 3}, nested(4), ErrMaxDepth},
+		{DefaultParseOptions, nested(40), ErrMaxDepth},
+		{ParseOptions{MaxParts: 4}, nested(3), nil},
+		{ParseOptions{MaxParts: 4}, nested(4), ErrMaxParts},
+		{ParseOptions{MaxBytes: 13}, nested(2), nil},
+		{ParseOptions{MaxBytes: 12}, nested(2), ErrMaxBytes},
+		{ParseOptions{MaxHeaderBytes: 64}, nested(1), nil},
+		{ParseOptions{MaxHeaderBytes: 16}, nested(1), ErrMaxHeaderBytes},
+		{ParseOptions{MaxHeaderBytes: 64}, []byte("Subject: " + strings.Repeat("x", 8192) + "\r\n\r\nHello"), ErrMaxHeaderBytes},
+		{ParseOptions{MaxHeaderBytes: 64}, bytes.Replace(nested(1), []byte("text/plain"), []byte(strings.Repeat("x", 100)), 1), ErrMaxHeaderBytes},
+	} {
+		e, err := tc.opt.NewEmailFromReader(bytes.NewReader(tc.raw))
+		if err != tc.want {
+			t.Errorf("%+v: expected error %v, got %v", tc.opt, tc.want, err)
+			continue
+		}
+		if (err == nil) && (string(e.Text) != "Hello, world!") {
+			t.Errorf("%+v: incorrect text: %#q", tc.opt, e.Text)
+		}
+	}
+
+	// A NESTED HEADER IS REFUSED BEFORE IT IS READ WHOLE
+	var nRead countingWriter
+	huge := io.TeeReader(io.MultiReader(strings.NewReader("Content-Type: multipart/mixed; boundary=B\r\n\r\n--B\r\nX-Huge: "),
+		infiniteX{}), &nRead)
+	if _, err := (ParseOptions{MaxHeaderBytes: 1024}).NewMIMETreeFromReader(huge); (err != ErrMaxHeaderBytes) || (nRead > 1<<16) {
+		t.Errorf("Expected ErrMaxHeaderBytes within 64KiB, got %v after %d bytes", err, nRead)
+	}
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	*cw += countingWriter(len(p))
+	return len(p), nil
+}
+
+// infiniteX reads an endless run of 'x'.
+type infiniteX struct{}
+
+func (infiniteX) Read(buf []byte) (int, error) {
+	for ix := range buf {
+		buf[ix] = 'x'
+	}
+	return len(buf), nil
+}
+
+func TestEmailInlineAttachment(t *testing.T) {
+
+	png := []byte("\x89PNG\r\n\x1a\n")
+
+	for _, tc := range []struct {
+		text, attach bool
+		want         string
+	}{
+		{false, false, "0:multipart/related 1:text/html 1:image/png"},
+		{true, false, "0:multipart/alternative 1:text/plain 1:multipart/related 2:text/html 2:image/png"},
+		{false, true, "0:multipart/mixed 1:multipart/related 2:text/html 2:image/png 1:text/plain"},
+		{true, true, "0:multipart/mixed 1:multipart/alternative 2:text/plain 2:multipart/related 3:text/html 3:image/png 1:text/plain"},
+	} {
+		msgIn := dummyEmail()
+		if tc.text {
+			msgIn.Text = []byte("Text Body is, of course, supported!")
+		}
+		pAt, err := msgIn.AttachInline(bytes.NewReader(png), "logo.png", "image/png")
+		if err != nil {
+			t.Fatal("Could not add an inline attachment to the message: ", err)
+		}
+		msgIn.HTML = []byte("<img src=\"cid:" + pAt.ContentID() + "\">")
+		if tc.attach {
+			if _, err := msgIn.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain"); err != nil {
+				t.Fatal("Could not add an attachment to the message: ", err)
+			}
+		}
+
+		raw, err := msgIn.Bytes()
+		if err != nil {
+			t.Fatal("Failed to render message: ", err)
+		}
+		pRoot, err := NewMIMETreeFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sTypes []string
+		pRoot.Walk(func(pNode *MIMENode, depth int) error {
+			ct, _ := pNode.MediaType()
+			sTypes = append(sTypes, fmt.Sprintf("%d:%s", depth, ct))
+			return nil
+		})
+		if got := strings.Join(sTypes, " "); got != tc.want {
+			t.Errorf("Incorrect structure: %#q != %#q", got, tc.want)
+		}
+
+		pImg := pRoot.FindByContentID("cid:" + pAt.ContentID())
+		if pImg == nil {
+			t.Fatal("Could not find inline part by Content-ID")
+		}
+		if disp, _, _ := mime.ParseMediaType(pImg.Header.Get("Content-Disposition")); disp != "inline" {
+			t.Errorf("Incorrect Content-Disposition: %#q", disp)
+		}
+
+		// inline flag must survive parsing
+		msgRead, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(msgRead.Attachments) == 0) || !msgRead.Attachments[0].Inline {
+			t.Errorf("Inline attachment not parsed as inline")
+		}
+	}
+
+	// parts sharing a filename get distinct Content-IDs
+	msgIn := dummyEmail()
+	pAt1, err := msgIn.AttachInline(bytes.NewReader(png), "logo.png", "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pAt2, err := msgIn.AttachInline(bytes.NewReader(png), "logo.png", "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pAt1.ContentID(), "@") || (pAt1.ContentID() == pAt2.ContentID()) {
+		t.Errorf("Expected unique Content-IDs, got %#q and %#q", pAt1.ContentID(), pAt2.ContentID())
+	}
+}
+
+// fakeServer is a minimal, scripted SMTP server for exercising Client.
+type fakeServer struct {
+	ext      []string       // EHLO keywords advertised
+	rcptCode map[string]int // RCPT response code by address (default 250)
+	cmds     []string       // commands received
+	data     [][]byte       // messages received
+}
+
+func (fs *fakeServer) serve(iConn net.Conn) {
+
+	tp := textproto.NewConn(iConn)
+	defer tp.Close()
+	tp.PrintfLine("220 fake ESMTP")
+
+	nRcpt := 0      // recipients accepted in this transaction
+	var bdat []byte // message received by BDAT, so far
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		fs.cmds = append(fs.cmds, line)
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			sLines := append([]string{"fake"}, fs.ext...)
+			for ix, ext := range sLines {
+				sep := "-"
+				if ix == len(sLines)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, ext)
+			}
+		case "RCPT":
+			addr := line[strings.Index(line, "<")+1 : strings.Index(line, ">")]
+			if code, ok := fs.rcptCode[addr]; ok {
+				tp.PrintfLine("%d 5.1.1 rejected <%s>", code, addr)
+			} else {
+				nRcpt++
+				tp.PrintfLine("250 2.1.5 ok")
+			}
+		case "DATA":
+			if nRcpt == 0 {
+				tp.PrintfLine("554 5.5.1 no valid recipients")
+				continue
+			}
+			nRcpt = 0
+			tp.PrintfLine("354 go ahead")
+			raw, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			// NOTE: ReadDotBytes converts CRLF to LF
+			fs.data = append(fs.data, bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n")))
+			tp.PrintfLine("250 2.0.0 queued")
+		case "BDAT":
+			sArgs := strings.Fields(line)
+			n, _ := strconv.Atoi(sArgs[1])
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(tp.R, chunk); err != nil {
+				return
+			}
+			bdat = append(bdat, chunk...)
+			if (len(sArgs) > 2) && strings.EqualFold(sArgs[2], "LAST") {
+				fs.data = append(fs.data, bdat)
+				bdat, nRcpt = nil, 0
+				tp.PrintfLine("250 2.0.0 queued")
+			} else {
+				tp.PrintfLine("250 2.0.0 %d octets received", n)
+			}
+		case "MAIL", "RSET":
+			nRcpt, bdat = 0, nil
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+// dial starts serving on a loopback listener and connects a Client to it.
+func (fs *fakeServer) dial(t *testing.T) *Client {
+	return fs.dialWith(t, nil)
+}
+
+// dialWith connects a Client to the fake server through `fnNewTextproto`.
+func (fs *fakeServer) dialWith(t *testing.T, fnNewTextproto CreateTextprotoConnFn) *Client {
+
+	pLsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer pLsn.Close()
+		if iConn, err := pLsn.Accept(); err == nil {
+			fs.serve(iConn)
+		}
+	}()
+
+	iConn, err := net.Dial("tcp", pLsn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pCli, err := NewClient(iConn, nil, "localhost", nil, fnNewTextproto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pCli
+}
+
+func TestClientSendStreams(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported!\r\n")
+	content := make([]byte, 256*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgIn.Attach(bytes.NewReader(content), "big.bin", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// WriteTo and Bytes must agree on size
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := msgIn.WriteTo(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < int64(len(content)) || n > int64(len(raw))+128 {
+		t.Errorf("Unexpected WriteTo size: %d (Bytes: %d)", n, len(raw))
+	}
+
+	fs := &fakeServer{}
+	pCli := fs.dial(t)
+	if err = pCli.Send(msgIn); err != nil {
+		t.Fatal(err)
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fs.data) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(fs.data))
+	}
+	msgRead, err := NewEmailFromReader(bytes.NewReader(fs.data[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msgRead.Text, msgIn.Text) {
+		t.Errorf("Incorrect text: %#q != %#q", msgRead.Text, msgIn.Text)
+	}
+	if (len(msgRead.Attachments) != 1) || !bytes.Equal(msgRead.Attachments[0].Content, content) {
+		t.Errorf("Attachment did not survive Send")
+	}
+}
+
+type closeCounter struct {
+	io.Reader
+	nClosed *int
+}
+
+func (cc closeCounter) Close() error {
+	*cc.nClosed++
+	return nil
+}
+
+func TestLazyAttachment(t *testing.T) {
+
+	content := make([]byte, 10000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	// streamed encoding must match in-memory encoding
+	var bufMem, bufRdr bytes.Buffer
+	base64Wrap(&bufMem, content)
+	if err := base64WrapReader(&bufRdr, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bufMem.Bytes(), bufRdr.Bytes()) {
+		t.Fatal("base64WrapReader output differs from base64Wrap")
+	}
+
+	fname := t.TempDir() + "/lazy.txt"
+	if err := os.WriteFile(fname, []byte("Rad attachment"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported!")
+
+	var nOpened, nClosed int
+	msgIn.AttachLazy(func() (io.ReadCloser, error) {
+		nOpened++
+		return closeCounter{bytes.NewReader(content), &nClosed}, nil
+	}, "lazy.bin", "")
+	if _, err := msgIn.AttachFileLazy(fname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgIn.AttachFileLazy(fname + ".missing"); err == nil {
+		t.Error("Expected error attaching missing file")
+	}
+
+	for ix := 1; ix <= 2; ix++ {
+		raw, err := msgIn.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (nOpened != ix) || (nClosed != ix) {
+			t.Errorf("Expected %d opens & closes, got %d & %d", ix, nOpened, nClosed)
+		}
+		msgRead, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgRead.Attachments) != 2 {
+			t.Fatalf("Expected 2 attachments, got %d", len(msgRead.Attachments))
+		}
+		if !bytes.Equal(msgRead.Attachments[0].Content, content) {
+			t.Error("Incorrect lazy attachment content")
+		}
+		if pAt := msgRead.Attachments[1]; (pAt.Filename != "lazy.txt") || (string(pAt.Content) != "Rad attachment") {
+			t.Errorf("Incorrect lazy file attachment: %#q %#q", pAt.Filename, pAt.Content)
+		}
+	}
+
+	// failures to open are reported
+	msgIn.AttachLazy(func() (io.ReadCloser, error) {
+		return nil, os.ErrNotExist
+	}, "gone.bin", "")
+	if _, err := msgIn.Bytes(); err != os.ErrNotExist {
+		t.Errorf("Expected open error, got %v", err)
+	}
+}
+
+func TestAttachmentFilenameEncoding(t *testing.T) {
+
+	sNames := []string{
+		"rad.txt",
+		"Überweisung.pdf",
+		`quote"and\back.txt`,
+		"Ein sehr langer Dateiname für die Überweisung vom letzten Monat (Kopie) – endgültig.pdf",
+		"请求.docx",
+	}
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported!")
+	for _, name := range sNames {
+		if _, err := msgIn.Attach(bytes.NewBufferString(name), name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ix, pAt := range msgIn.Attachments {
+		cid := pAt.Header.Get("Content-ID")
+		if !isDotAtom(strings.Trim(strings.Replace(cid, "@", ".", 1), "<>")) {
+			t.Errorf("Content-ID not ASCII: %#q", cid)
+		} else if (ix == 0) != (cid == "<rad.txt>") {
+			t.Errorf("Unexpected Content-ID: %#q", cid)
+		}
+		disp := pAt.Header.Get("Content-Disposition")
+		for _, line := range strings.Split(disp, "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("Content-Disposition line too long: %#q", line)
+			}
+			for _, c := range []byte(line) {
+				if c >= 0x7F {
+					t.Errorf("Content-Disposition not ASCII: %#q", line)
+					break
+				}
+			}
+		}
+	}
+
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgRead, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgRead.Attachments) != len(sNames) {
+		t.Fatalf("Expected %d attachments, got %d", len(sNames), len(msgRead.Attachments))
+	}
+	for ix, name := range sNames {
+		if got := msgRead.Attachments[ix].Filename; got != name {
+			t.Errorf("Incorrect filename: %#q != %#q", got, name)
+		}
+	}
+
+	// clients that only read the RFC 2047 fallback
+	for _, name := range []string{sNames[1], sNames[3], sNames[4]} {
+		disp := dispositionHeader("attachment", name)
+		fallback := disp[strings.LastIndex(disp, "filename=\"")+len("filename=\"") : len(disp)-1]
+		if got := decodeHdr(strings.ReplaceAll(fallback, "\r\n", "")); got != name {
+			t.Errorf("Incorrect fallback filename: %#q != %#q", got, name)
+		}
+	}
+}
+
+func TestAddressHeaderEncoding(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.From = "Mrs Valérie Dupont <valerie.dupont@example.com>"
+	msgIn.To = []string{
+		"Anaïs <anais@example.org>",
+		"\"Fältström, Patrik\" <paf@example.com>",
+		"plain@example.com",
+		"Jordan Wright <jmwright798@gmail.com>, another@example.com",
+	}
+	msgIn.Cc = nil
+	msgIn.Text = []byte("Text Body is, of course, supported!")
+
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header lines must be ASCII, folded, and must never encode the address
+	hdrs := raw[:bytes.Index(raw, []byte("\r\n\r\n"))]
+	for _, line := range strings.Split(string(hdrs), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Header line too long: %#q", line)
+		}
+		if strings.Contains(line, "=?") && strings.Contains(line, "@") &&
+			strings.Index(line, "@") < strings.LastIndex(line, "?=") {
+			t.Errorf("Address swallowed by encoded-word: %#q", line)
+		}
+	}
+
+	msgOut, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sTo, err := msgOut.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mail.Address{
+		{Name: "Anaïs", Address: "anais@example.org"},
+		{Name: "Fältström, Patrik", Address: "paf@example.com"},
+		{Address: "plain@example.com"},
+		{Name: "Jordan Wright", Address: "jmwright798@gmail.com"},
+		{Address: "another@example.com"},
+	}
+	if len(sTo) != len(want) {
+		t.Fatalf("Expected %d addresses, got %d", len(want), len(sTo))
+	}
+	for ix := range want {
+		if *sTo[ix] != want[ix] {
+			t.Errorf("Incorrect address: %#v != %#v", *sTo[ix], want[ix])
+		}
+	}
+	pFrom, err := mail.ParseAddress(msgOut.Header.Get("From"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pFrom.Name != "Mrs Valérie Dupont" {
+		t.Errorf("Incorrect From name: %#q", pFrom.Name)
+	}
+}
+
+func TestHeaderOrderAndFolding(t *testing.T) {
+
+	var sRefs []string
+	for ix := 0; ix < 40; ix++ {
+		sRefs = append(sRefs, fmt.Sprintf("<%d.thread-message-id@mail.example.com>", ix))
+	}
+
+	msgIn := dummyEmail()
+	msgIn.Subject = "A subject that is long enough to need folding, since it runs well past the seventy-eight column limit"
+	msgIn.Text = []byte("Text Body is, of course, supported!")
+	msgIn.Headers.Set("Date", "Wed, 18 Nov 2009 01:02:38 +0600")
+	msgIn.Headers.Set("Message-Id", "<87iqd9rn3l.fsf@vertex.dottedmag>")
+	msgIn.Headers.Set("References", strings.Join(sRefs, " "))
+	msgIn.Headers.Set("X-Zebra", "last")
+	msgIn.Headers.Set("X-Alpha", "first")
+
+	headerBlock := func() string {
+		raw, err := msgIn.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(raw[:bytes.Index(raw, []byte("\r\n\r\n"))])
+	}
+
+	hdrs := headerBlock()
+	for ix := 0; ix < 10; ix++ {
+		if headerBlock() != hdrs {
+			t.Fatal("Header order is not deterministic")
+		}
+	}
+
+	var sFields []string
+	for _, line := range strings.Split(hdrs, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Header line too long: %#q", line)
+		}
+		if !strings.HasPrefix(line, " ") {
+			sFields = append(sFields, line[:strings.Index(line, ":")])
+		}
+	}
+	want := "From To Cc Subject Date Message-Id References Mime-Version Content-Type Content-Transfer-Encoding X-Alpha X-Zebra"
+	if got := strings.Join(sFields, " "); got != want {
+		t.Errorf("Incorrect header order: %#q != %#q", got, want)
+	}
+
+	msgOut, err := mail.ReadMessage(strings.NewReader(hdrs + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msgOut.Header.Get("References"); got != strings.Join(sRefs, " ") {
+		t.Errorf("References did not unfold correctly: %#q", got)
+	}
+	if got := msgOut.Header.Get("Subject"); got != msgIn.Subject {
+		t.Errorf("Subject did not unfold correctly: %#q", got)
+	}
+}
+
+func TestDKIMCanonicalization(t *testing.T) {
+
+	// RFC 6376, section 3.4.6
+	raw := []byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n")
+	sHdrs, body := splitMessage(raw)
+
+	var relaxed, simple string
+	for _, hdr := range sHdrs {
+		relaxed += canonicalHeader(hdr, DKIMRelaxed)
+		simple += canonicalHeader(hdr, DKIMSimple)
+	}
+	if want := "a:X\r\nb:Y Z\r\n"; relaxed != want {
+		t.Errorf("relaxed headers: %#q != %#q", relaxed, want)
+	}
+	if want := "A: X\r\nB : Y\t\r\n\tZ  \r\n"; simple != want {
+		t.Errorf("simple headers: %#q != %#q", simple, want)
+	}
+	if got, want := string(canonicalBody(body, DKIMRelaxed)), " C\r\nD E\r\n"; got != want {
+		t.Errorf("relaxed body: %#q != %#q", got, want)
+	}
+	if got, want := string(canonicalBody(body, DKIMSimple)), " C \r\nD \t E\r\n"; got != want {
+		t.Errorf("simple body: %#q != %#q", got, want)
+	}
+	if got := string(canonicalBody(nil, DKIMSimple)); got != "\r\n" {
+		t.Errorf("simple empty body: %#q", got)
+	}
+	if got := string(canonicalBody([]byte("\r\n\r\n"), DKIMRelaxed)); got != "" {
+		t.Errorf("relaxed empty body: %#q", got)
+	}
+}
+
+// checkDKIM verifies that `signed` carries a single, valid DKIM-Signature by `pub`.
+func checkDKIM(t *testing.T, signed []byte, pub crypto.PublicKey) {
+	rec, err := DKIMKeyRecord(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sRes := VerifyDKIM(signed, DKIMKeyMap{"sel._domainkey.test.com": rec})
+	if len(sRes) != 1 {
+		t.Fatalf("Expected 1 DKIM result, got %d", len(sRes))
+	}
+	if sRes[0].Err != nil {
+		t.Fatal("DKIM verification failed: ", sRes[0].Err)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+
+	pRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported!  \r\nWith  odd\tspacing.\r\n\r\n")
+	msgIn.HTML = []byte("<h1>Fancy Html is supported, too!</h1>")
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{pRSA, edKey} {
+		for _, canon := range []string{DKIMSimple, DKIMRelaxed} {
+			d := &DKIMSigner{
+				Domain:      "test.com",
+				Selector:    "sel",
+				Key:         key,
+				HeaderCanon: canon,
+				BodyCanon:   canon,
+			}
+			signed, err := d.Sign(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(signed, raw) {
+				t.Fatal("Signed message does not end with original message")
+			}
+			for _, line := range strings.Split(string(signed[:len(signed)-len(raw)]), "\r\n") {
+				if len(line) > 78 {
+					t.Errorf("DKIM-Signature line too long: %#q", line)
+				}
+			}
+			checkDKIM(t, signed, key.Public())
+		}
+	}
+
+	if _, err := (&DKIMSigner{Domain: "test.com", Key: edKey}).Sign(raw); err != ErrInvalidDKIMSigner {
+		t.Errorf("Expected ErrInvalidDKIMSigner, got %v", err)
+	}
+
+	// signing through Client.Send
+	fs := &fakeServer{}
+	pCli := fs.dial(t)
+	pCli.DKIM = &DKIMSigner{Domain: "test.com", Selector: "sel", Key: edKey}
+	if err = pCli.Send(msgIn); err != nil {
+		t.Fatal(err)
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	checkDKIM(t, fs.data[0], edKey.Public())
+}
+
+func TestDKIMVerify(t *testing.T) {
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := DKIMKeyRecord(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := DKIMKeyMap{"sel._domainkey.test.com": rec}
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported!")
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sRes := VerifyDKIM(raw, keys); len(sRes) != 0 {
+		t.Errorf("Expected no results for unsigned message, got %d", len(sRes))
+	}
+
+	d := &DKIMSigner{Domain: "test.com", Selector: "sel", Key: edKey}
+	signed, err := d.Sign(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// second signature, by an unknown selector, on top of the first
+	d2 := &DKIMSigner{Domain: "test.com", Selector: "other", Key: edKey}
+	signed2, err := d2.Sign(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sRes := VerifyDKIM(signed2, keys)
+	if len(sRes) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(sRes))
+	}
+	if (sRes[0].Selector != "other") || (sRes[0].Err != ErrDKIMKeyUnavailable) {
+		t.Errorf("Expected unavailable key for `other`, got %+v", sRes[0])
+	}
+	if (sRes[1].Selector != "sel") || (sRes[1].Err != nil) || (sRes[1].BodyLength != -1) {
+		t.Errorf("Expected valid signature for `sel`, got %+v", sRes[1])
+	}
+
+	// LF line endings, as from a local mailbox file
+	if sRes := VerifyDKIM(bytes.Replace(signed, []byte("\r\n"), []byte("\n"), -1), keys); sRes[0].Err != nil {
+		t.Errorf("Expected LF line endings to verify, got %v", sRes[0].Err)
+	}
+
+	// tampering
+	tampered := bytes.Replace(signed, []byte("supported!"), []byte("supported?"), 1)
+	if sRes := VerifyDKIM(tampered, keys); sRes[0].Err != ErrDKIMBodyHash {
+		t.Errorf("Expected body hash failure, got %v", sRes[0].Err)
+	}
+	tampered = bytes.Replace(signed, []byte("Subject: Test Subject"), []byte("Subject: Test Subjects"), 1)
+	if sRes := VerifyDKIM(tampered, keys); sRes[0].Err != ErrDKIMSignature {
+		t.Errorf("Expected signature failure, got %v", sRes[0].Err)
+	}
+	if sRes := VerifyDKIM(signed, DKIMKeyMap{"sel._domainkey.test.com": "v=DKIM1; k=ed25519; p="}); sRes[0].Err != ErrDKIMKeyUnavailable {
+		t.Errorf("Expected revoked key failure, got %v", sRes[0].Err)
+	}
+
+	// l= limits the signed body; content appended afterwards still verifies
+	lim := []byte("DKIM-Signature: v=1; a=ed25519-sha256; c=simple/relaxed; d=test.com; s=sel;\r\n" +
+		" h=from:subject; l=8; bh=")
+	body := "Hello!\r\n"
+	bh := sha256.Sum256([]byte(body))
+	lim = append(lim, base64.StdEncoding.EncodeToString(bh[:])+"; b="...)
+	hdrs := "From: test@test.com\r\nSubject: Limited\r\n"
+	hash := sha256.New()
+	hash.Write([]byte(hdrs))
+	hash.Write(lim)
+	lim = append(lim, base64.StdEncoding.EncodeToString(ed25519.Sign(edKey, hash.Sum(nil)))+"\r\n"...)
+	lim = append(lim, hdrs+"\r\n"+body+"Appended by a mailing list.\r\n"...)
+	sRes = VerifyDKIM(lim, keys)
+	if (len(sRes) != 1) || (sRes[0].Err != nil) || (sRes[0].BodyLength != 8) {
+		t.Errorf("Expected valid l= signature, got %+v", sRes)
+	}
+}
+
+// smimeCert issues a certificate for `key`, signed by `pParent` (or self-signed).
+func smimeCert(t *testing.T, key *rsa.PrivateKey, pParent *x509.Certificate, parentKey *rsa.PrivateKey, serial int64) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("test %d", serial)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	if pParent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		pParent, parentKey = tmpl, key
+	} else {
+		tmpl.EmailAddresses = []string{"test@test.com"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, pParent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pCert
+}
+
+func TestSMIME(t *testing.T) {
+
+	var sKeys []*rsa.PrivateKey
+	for ix := 0; ix < 3; ix++ {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sKeys = append(sKeys, key)
+	}
+	caCert := smimeCert(t, sKeys[0], nil, nil, 1)
+	cert := smimeCert(t, sKeys[1], caCert, sKeys[0], 2)
+	otherCert := smimeCert(t, sKeys[2], caCert, sKeys[0], 3)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	opts := x509.VerifyOptions{Roots: roots}
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported!\r\n")
+	msgIn.HTML = []byte("<h1>Fancy HTML is supported, too!</h1>\r\n")
+	msgIn.SMIME = &SMIME{Certificate: cert, Key: sKeys[1]}
+
+	// SIGNED
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pMsg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, params, _ := mime.ParseMediaType(pMsg.Header.Get("Content-Type")); (ct != "multipart/signed") || (params["protocol"] != "application/pkcs7-signature") {
+		t.Errorf("Expected multipart/signed, got %q", pMsg.Header.Get("Content-Type"))
+	}
+	pSigner, content, err := VerifySMIME(raw, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pSigner.Equal(cert) {
+		t.Errorf("Expected signer %v, got %v", cert.Subject, pSigner.Subject)
+	}
+	msgOut, err := NewEmailFromReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (msgOut.Subject != msgIn.Subject) || !bytes.Equal(msgOut.Text, msgIn.Text) || !bytes.Equal(msgOut.HTML, msgIn.HTML) {
+		t.Errorf("Verified message differs: %+v", msgOut)
+	}
+
+	if _, _, err := VerifySMIME(bytes.Replace(raw, []byte("supported!"), []byte("supported?"), 1), opts); err != ErrSMIMESignature {
+		t.Errorf("Expected signature failure, got %v", err)
+	}
+	if _, _, err := VerifySMIME(raw, x509.VerifyOptions{Roots: x509.NewCertPool()}); err == nil {
+		t.Error("Expected untrusted signer to fail")
+	}
+	if _, _, err := VerifySMIME(bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1), opts); err != nil {
+		t.Errorf("Expected LF line endings to verify, got %v", err)
+	}
+
+	// SIGNED CONTENT-TYPE ATTRIBUTE MUST MATCH
+	_, mHdr, body, _ := splitRawMessage(raw)
+	_, params, _ := mime.ParseMediaType(mHdr.Get("Content-Type"))
+	entity, _, p7s, err := splitSigned(body, params["boundary"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sd pkcs7SignedData
+	if err := parseContentInfo(p7s, oidSignedData, &sd); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignerInfo(sd.SignerInfos[0], cert, oidData, entity); err != nil {
+		t.Errorf("Expected signer info to verify, got %v", err)
+	}
+	if err := verifySignerInfo(sd.SignerInfos[0], cert, oidEnvelopedData, entity); err != ErrSMIMESignature {
+		t.Errorf("Expected content type mismatch, got %v", err)
+	}
+
+	// BER NESTING IS BOUNDED
+	nested := append(bytes.Repeat([]byte{0x30, 0x80}, 10), 0x05, 0x00)
+	if _, err := berToDER(append(nested, make([]byte, 20)...)); err != nil {
+		t.Errorf("Expected nested BER to convert, got %v", err)
+	}
+	if _, err := berToDER(bytes.Repeat([]byte{0x30, 0x80}, 100000)); err != ErrSMIMEMalformed {
+		t.Errorf("Expected ErrSMIMEMalformed, got %v", err)
+	}
+
+	// SIGNED & ENCRYPTED
+	msgIn.SMIME.Recipients = []*x509.Certificate{cert}
+	raw, err = msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("supported")) {
+		t.Error("Expected encrypted content")
+	}
+	if _, _, err := VerifySMIME(raw, opts); err != ErrSMIMENotSigned {
+		t.Errorf("Expected ErrSMIMENotSigned, got %v", err)
+	}
+	if _, err := (&SMIME{Certificate: otherCert, Key: sKeys[2]}).Decrypt(raw); err != ErrSMIMENoRecipient {
+		t.Errorf("Expected ErrSMIMENoRecipient, got %v", err)
+	}
+	dec, err := msgIn.SMIME.Decrypt(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, content, err = VerifySMIME(dec, opts); err != nil {
+		t.Fatal(err)
+	}
+	msgOut, err = NewEmailFromReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (msgOut.Subject != msgIn.Subject) || !bytes.Equal(msgOut.Text, msgIn.Text) {
+		t.Errorf("Decrypted message differs: %+v", msgOut)
+	}
+
+	// ENCRYPTED ONLY
+	msgIn.SMIME = &SMIME{Recipients: []*x509.Certificate{otherCert}}
+	if raw, err = msgIn.Bytes(); err != nil {
+		t.Fatal(err)
+	}
+	if dec, err = (&SMIME{Certificate: otherCert, Key: sKeys[2]}).Decrypt(raw); err != nil {
+		t.Fatal(err)
+	}
+	if msgOut, err = NewEmailFromReader(bytes.NewReader(dec)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msgOut.HTML, msgIn.HTML) {
+		t.Errorf("Decrypted message differs: %+v", msgOut)
+	}
+
+	// BAD PADDING: FLIP THE LAST BYTE OF THE PENULTIMATE CIPHERTEXT BLOCK
+	sHdrs, mHdr, body, err := splitRawMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7m, err := io.ReadAll(decodeTransfer(bytes.NewReader(body), mHdr.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7m[len(p7m)-17] ^= 0xff
+	bad := []byte(strings.Join(sHdrs, "") + "\r\n" + base64.StdEncoding.EncodeToString(p7m) + "\r\n")
+	if _, err = (&SMIME{Certificate: otherCert, Key: sKeys[2]}).Decrypt(bad); err != ErrSMIMEDecrypt {
+		t.Errorf("Expected ErrSMIMEDecrypt, got %v", err)
+	}
+}
+
+// fakePGP stands in for an OpenPGP implementation: its "signature" is a
+// SHA-256 digest, and its "encryption" is base64, each ASCII-armored.
+type fakePGP struct{}
+
+func fakeArmor(kind string, data []byte) []byte {
+	return []byte("-----BEGIN PGP " + kind + "-----\n\n" + base64.StdEncoding.EncodeToString(data) + "\n-----END PGP " + kind + "-----\n")
+}
+
+func fakeDearmor(armored []byte) ([]byte, error) {
+	sLines := strings.Split(strings.TrimSpace(string(armored)), "\r\n")
+	if len(sLines) != 4 {
+		return nil, fmt.Errorf("bad armor: %q", armored)
+	}
+	return base64.StdEncoding.DecodeString(sLines[2])
+}
+
+func (fakePGP) DetachSign(data []byte) ([]byte, string, error) {
+	sum := sha256.Sum256(data)
+	return fakeArmor("SIGNATURE", sum[:]), "SHA256", nil
+}
+
+func (fakePGP) VerifyDetached(data, sig []byte) (string, error) {
+	sum, err := fakeDearmor(sig)
+	if err != nil {
+		return "", err
+	}
+	if want := sha256.Sum256(data); !bytes.Equal(sum, want[:]) {
+		return "", fmt.Errorf("bad signature")
+	}
+	return "fake", nil
+}
+
+func (fakePGP) Encrypt(data []byte) ([]byte, error) { return fakeArmor("MESSAGE", data), nil }
+
+func (fakePGP) Decrypt(msg []byte) ([]byte, error) { return fakeDearmor(msg) }
+
+func TestOpenPGP(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Text Body is, of course, supported! \r\nFrom here on out.\r\n")
+	msgIn.OpenPGP = &OpenPGP{Signer: fakePGP{}}
+
+	// SIGNED
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(raw, []byte("\n")) != bytes.Count(raw, []byte("\r\n")) {
+		t.Error("Expected CRLF line endings throughout")
+	}
+	msgOut, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsOpenPGPSigned(msgOut.Headers) || IsOpenPGPEncrypted(msgOut.Headers) {
+		t.Errorf("Expected OpenPGP signed message, got %q", msgOut.Headers.Get("Content-Type"))
+	}
+	if _, params, _ := mime.ParseMediaType(msgOut.Headers.Get("Content-Type")); params["micalg"] != "pgp-sha256" {
+		t.Errorf("Expected micalg=pgp-sha256, got %q", params["micalg"])
+	}
+	signer, content, err := VerifyOpenPGP(raw, fakePGP{})
+	if (err != nil) || (signer != "fake") {
+		t.Fatal(signer, err)
+	}
+	if msgOut, err = NewEmailFromReader(bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if (msgOut.Subject != msgIn.Subject) || !bytes.Equal(msgOut.Text, msgIn.Text) {
+		t.Errorf("Verified message differs: %+v", msgOut)
+	}
+	if _, _, err := VerifyOpenPGP(bytes.Replace(raw, []byte("out."), []byte("in."), 1), fakePGP{}); err == nil {
+		t.Error("Expected tampered message to fail verification")
+	}
+
+	// SIGNED & ENCRYPTED
+	msgIn.OpenPGP.Encrypter = fakePGP{}
+	if raw, err = msgIn.Bytes(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("supported")) {
+		t.Error("Expected encrypted content")
+	}
+	if _, _, err := VerifyOpenPGP(raw, fakePGP{}); err != ErrOpenPGPNotSigned {
+		t.Errorf("Expected ErrOpenPGPNotSigned, got %v", err)
+	}
+	dec, err := DecryptOpenPGP(raw, fakePGP{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, content, err = VerifyOpenPGP(dec, fakePGP{}); err != nil {
+		t.Fatal(err)
+	}
+	if msgOut, err = NewEmailFromReader(bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msgOut.Text, msgIn.Text) {
+		t.Errorf("Decrypted message differs: %+v", msgOut)
+	}
+
+	msgIn.SMIME = &SMIME{}
+	if _, err := msgIn.Bytes(); err != ErrSMIMEAndOpenPGP {
+		t.Errorf("Expected ErrSMIMEAndOpenPGP, got %v", err)
+	}
+}
+
+func TestCalendarInvite(t *testing.T) {
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	ev := &Event{
+		UID:         "meeting-1@test.com",
+		Summary:     "Quarterly review; all hands, bring notes",
+		Description: "Agenda:\n1. numbers\n2. more numbers",
+		Location:    "Room 101",
+		Start:       time.Date(2026, time.October, 20, 9, 0, 0, 0, loc),
+		End:         time.Date(2026, time.October, 20, 10, 30, 0, 0, loc),
+		RRule:       "FREQ=WEEKLY;COUNT=4",
+		Organizer:   Attendee{Name: "Test Sender", Email: "test@test.com"},
+		Attendees: []Attendee{
+			{Name: "Doe, Jane", Email: "recipient@test.com", RSVP: true},
+			{Email: "recipient2@test.com", Role: "OPT-PARTICIPANT"},
+		},
+	}
+	ics, err := ev.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"METHOD:REQUEST\r\n",
+		"BEGIN:VTIMEZONE\r\nTZID:America/New_York\r\n",
+		"RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU\r\n",
+		"RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=1SU\r\n",
+		"DTSTART;TZID=America/New_York:20261020T090000\r\n",
+		"SUMMARY:Quarterly review\\; all hands\\, bring notes\r\n",
+		"ATTENDEE;CN=\"Doe, Jane\";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRU\r\n E:mailto:recipient@test.com\r\n",
+	} {
+		if !bytes.Contains(ics, []byte(want)) {
+			t.Errorf("Expected %q in:\n%s", want, ics)
+		}
+	}
+	for _, ln := range strings.Split(string(ics), "\r\n") {
+		if len(ln) > 75 {
+			t.Errorf("Line too long: %q", ln)
+		}
+	}
+
+	// CALENDAR IS THE LAST ALTERNATIVE
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("You are invited.")
+	msgIn.HTML = []byte("<p>You are invited.</p>")
+	msgIn.Calendar = ics
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pRoot, err := NewMIMETreeFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sTypes []string
+	for _, pChild := range pRoot.Children {
+		sTypes = append(sTypes, pChild.Header.Get("Content-Type"))
+	}
+	if ct, _ := pRoot.MediaType(); (ct != "multipart/alternative") || (len(sTypes) != 3) ||
+		(sTypes[2] != "text/calendar; method=REQUEST; charset=UTF-8") {
+		t.Errorf("Unexpected structure: %s %q", ct, sTypes)
+	}
+
+	msgOut, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evOut, err := ParseEvent(msgOut.Calendar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (evOut.Method != MethodRequest) || (evOut.UID != ev.UID) || (evOut.Summary != ev.Summary) ||
+		(evOut.Description != ev.Description) || !evOut.Start.Equal(ev.Start) || !evOut.End.Equal(ev.End) ||
+		(evOut.RRule != ev.RRule) || (evOut.Organizer.Email != "test@test.com") || (len(evOut.Attendees) != 2) ||
+		(evOut.Attendees[0].Name != "Doe, Jane") || !evOut.Attendees[0].RSVP || (evOut.Attendees[1].Role != "OPT-PARTICIPANT") {
+		t.Errorf("Parsed event differs: %+v", evOut)
+	}
+
+	// CALENDAR ALONE
+	msgIn = dummyEmail()
+	ev.Method = MethodCancel
+	if msgIn.Calendar, err = ev.Bytes(); err != nil {
+		t.Fatal(err)
+	}
+	pMsg := basicTests(t, msgIn)
+	if ct := pMsg.Header.Get("Content-Type"); ct != "text/calendar; method=CANCEL; charset=UTF-8" {
+		t.Errorf("Unexpected Content-Type: %q", ct)
+	}
+
+	// INJECTED PROPERTIES & UNKNOWN VALUES
+	for _, fn := range []func(*Event){
+		func(e *Event) { e.Organizer.Email = "o@test.com\r\nX-EVIL:1" },
+		func(e *Event) { e.RRule = "FREQ=DAILY\r\nATTACH:http://evil" },
+		func(e *Event) { e.Method = "BOGUS" },
+		func(e *Event) { e.Status = "CONFIRMED\nX-EVIL:1" },
+		func(e *Event) { e.Attendees = []Attendee{{Email: "a@test.com", Role: "CHAIR;X=1"}} },
+	} {
+		evBad := *ev
+		fn(&evBad)
+		if _, err := evBad.Bytes(); err != ErrInvalidEvent {
+			t.Errorf("Expected ErrInvalidEvent for %+v, got %v", evBad, err)
+		}
+	}
+
+	// INBOUND REPLY
+	reply := "BEGIN:VCALENDAR\nMETHOD:REPLY\nBEGIN:VEVENT\nUID:meeting-1@test.com\nDTSTART:20261020T130000Z\n" +
+		"ATTENDEE;PARTSTAT=ACCEPTED;CN=\"Doe, Jane\":mailto:recipient@\n\ttest.com\nBEGIN:VALARM\nDESCRIPTION:Reminder\n" +
+		"END:VALARM\nEND:VEVENT\nEND:VCALENDAR\n"
+	evOut, err = ParseEvent([]byte(reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (evOut.Method != MethodReply) || (len(evOut.Attendees) != 1) || (evOut.Attendees[0].PartStat != "ACCEPTED") ||
+		(evOut.Attendees[0].Email != "recipient@test.com") || (len(evOut.Description) > 0) || !evOut.Start.Equal(ev.Start) {
+		t.Errorf("Parsed reply differs: %+v", evOut)
+	}
+	if _, err := ParseEvent([]byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")); err != ErrNoEvent {
+		t.Errorf("Expected ErrNoEvent, got %v", err)
+	}
+}
+
+func TestAlternativeBodies(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Plain")
+	msgIn.HTML = []byte(`<p>HTML <img src="cid:logo"></p>`)
+	msgIn.Calendar = []byte("BEGIN:VCALENDAR\r\nMETHOD:PUBLISH\r\nEND:VCALENDAR\r\n")
+	msgIn.Alternatives = []Body{
+		{ContentType: "text/x-amp-html", Content: []byte("<html amp4email>AMP</html>")},
+		{ContentType: "text/watch-html", Content: []byte("<b>Watch</b>")},
+		{ContentType: "text/enriched", Content: []byte("<bold>Enriched</bold>")},
+	}
+	if _, err := msgIn.AttachInline(strings.NewReader("PNG"), "logo.png", "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pRoot, err := NewMIMETreeFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sTypes []string
+	for _, pChild := range pRoot.Children {
+		ct, _ := pChild.MediaType()
+		sTypes = append(sTypes, ct)
+	}
+	want := []string{"text/plain", "text/enriched", "text/watch-html", "text/x-amp-html", "multipart/related", "text/calendar"}
+	if ct, _ := pRoot.MediaType(); (ct != "multipart/alternative") || (strings.Join(sTypes, " ") != strings.Join(want, " ")) {
+		t.Errorf("Expected %q in multipart/alternative, got %q in %s", want, sTypes, ct)
+	}
+
+	msgOut, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(msgOut.Alternatives) != 3) || (msgOut.Alternatives[1].ContentType != "text/watch-html") ||
+		!bytes.Equal(msgOut.Alternatives[2].Content, msgIn.Alternatives[0].Content) {
+		t.Errorf("Unexpected alternatives: %+v", msgOut.Alternatives)
+	}
+	if !bytes.Equal(msgOut.HTML, msgIn.HTML) || (len(msgOut.Attachments) != 1) || (len(msgOut.Calendar) == 0) {
+		t.Errorf("Parsed message differs: %+v", msgOut)
+	}
+
+	// A SINGLE ALTERNATIVE IS THE WHOLE BODY
+	msgIn = dummyEmail()
+	msgIn.Alternatives = []Body{{ContentType: "text/watch-html", Content: []byte("<b>Watch</b>")}}
+	if pMsg := basicTests(t, msgIn); pMsg.Header.Get("Content-Type") != "text/watch-html; charset=UTF-8" {
+		t.Errorf("Unexpected Content-Type: %q", pMsg.Header.Get("Content-Type"))
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+
+	src := `<html><head><title>Ignored</title><style>p { color: red }</style></head><body>
+<h1>Hello &amp; welcome</h1>
+<p>This paragraph is long enough that it has to be wrapped, since it runs well past the line length.</p>
+<h2>Lists</h2>
+<ul><li>one <a href="https://example.com/a">link</a></li><li>two<ol><li>nested</li><li>more</li></ol></li></ul>
+<blockquote><p>quoted</p><p>twice</p></blockquote>
+<p>See <a href="https://example.com/">https://example.com/</a> <img src="cid:x" alt="logo"><script>alert(1)</script></p>
+</body></html>`
+
+	want := "Hello & welcome\n" +
+		"===============\n" +
+		"\n" +
+		"This paragraph is long enough that it has to be wrapped, since it runs well\n" +
+		"past the line length.\n" +
+		"\n" +
+		"Lists\n" +
+		"-----\n" +
+		"\n" +
+		"* one link[1]\n" +
+		"* two\n" +
+		"  1. nested\n" +
+		"  2. more\n" +
+		"\n" +
+		"> quoted\n" +
+		">\n" +
+		"> twice\n" +
+		"\n" +
+		"See https://example.com/ [logo]\n" +
+		"\n" +
+		"[1] https://example.com/a\n"
+
+	if got := string(HTMLToText([]byte(src))); got != want {
+		t.Errorf("HTMLToText() =\n%s\nwant\n%s", got, want)
+	}
+
+	// SKIPPED CONTENT MAY CHANGE LENGTH WHEN LOWERCASED
+	for _, ch := range []string{"Ⱥ", "İ"} {
+		src = "<p>a</p><STYLE>" + strings.Repeat(ch, 10) + "</Style><p>b</p>"
+		if got := string(HTMLToText([]byte(src))); got != "a\n\nb\n" {
+			t.Errorf("HTMLToText(%q) = %q", src, got)
+		}
+	}
+
+	// AUTOMATIC PLAINTEXT ALTERNATIVE
+	msgIn := dummyEmail()
+	msgIn.Text = nil
+	msgIn.HTML = []byte("<p>Hi <b>there</b></p>")
+	msgIn.AutoText = true
+	raw, err := msgIn.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgIn.Text != nil {
+		t.Error("AutoText modified Email.Text")
+	}
+	msgOut, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msgOut.Text) != "Hi there\r\n" || !bytes.Equal(msgOut.HTML, msgIn.HTML) {
+		t.Errorf("Unexpected bodies: %q, %q", msgOut.Text, msgOut.HTML)
+	}
+}
+
+func TestMerge(t *testing.T) {
+
+	tmpl, err := NewTemplate("Hello, {{.Name}}", "Dear {{.Name}},\r\n", "<p>Dear {{.Name}},</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := dummyEmail()
+	base.Headers = textproto.MIMEHeader{"To": {"ignored@example.com"}, "X-Campaign": {"spring"},
+		"Message-Id": {"<base@test.com>"}, "Date": {"Mon, 02 Jan 2006 15:04:05 -0700"}}
+
+	sRecips := []Recipient{
+		{To: []string{"a@example.com"}, Data: map[string]string{"Name": "Ann"}},
+		{To: []string{"bad@example.com"}, Data: map[string]string{"Name": "Bad"}},
+		{To: []string{"c@example.com"}, Cc: []string{"d@example.com"}, Data: map[string]string{"Name": "<Cy>"}},
+	}
+
+	fs := &fakeServer{rcptCode: map[string]int{"bad@example.com": 550}}
+	pCli := fs.dial(t)
+	var sSkipped []string
+	nSent, err := pCli.Merge(tmpl, base, Recipients(sRecips), func(pRecip *Recipient, err error) error {
+		sSkipped = append(sSkipped, pRecip.To[0])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if (nSent != 2) || (len(fs.data) != 2) || (strings.Join(sSkipped, ",") != "bad@example.com") {
+		t.Fatalf("Expected 2 sent & 1 skipped, got %d (%d received), skipped %q", nSent, len(fs.data), sSkipped)
+	}
+	nRset := 0
+	for _, cmd := range fs.cmds {
+		if cmd == "RSET" {
+			nRset++
+		}
+	}
+	if nRset != 1 {
+		t.Errorf("Expected the skipped transaction to be reset once: %q", fs.cmds)
+	}
+
+	// THE BASE'S CC & BCC RECEIVE NONE OF THE PERSONALIZED MESSAGES
+	var sRcpts []string
+	for _, cmd := range fs.cmds {
+		if strings.HasPrefix(cmd, "RCPT TO:") {
+			sRcpts = append(sRcpts, cmd)
+		}
+	}
+	if sGot := strings.Join(sRcpts, ","); sGot != "RCPT TO:<a@example.com>,RCPT TO:<bad@example.com>,RCPT TO:<c@example.com>,RCPT TO:<d@example.com>" {
+		t.Errorf("Unexpected recipients: %q", sGot)
+	}
+	msgOut0, err := NewEmailFromReader(bytes.NewReader(fs.data[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgOut, err := NewEmailFromReader(bytes.NewReader(fs.data[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (msgOut.Subject != "Hello, <Cy>") || (strings.Join(msgOut.To, ",") != "c@example.com") ||
+		(strings.Join(msgOut.Cc, ",") != "d@example.com") || (msgOut.Headers.Get("X-Campaign") != "spring") {
+		t.Errorf("Unexpected headers: %q, %q, %v", msgOut.Subject, msgOut.To, msgOut.Headers)
+	}
+	if id := msgOut.Headers.Get("Message-Id"); (id == "<base@test.com>") || (id == msgOut0.Headers.Get("Message-Id")) ||
+		(msgOut.Headers.Get("Date") == base.Headers.Get("Date")) {
+		t.Errorf("Expected a Message-Id & Date per message, got %v", msgOut.Headers)
+	}
+	if (string(msgOut.Text) != "Dear <Cy>,\r\n") || (string(msgOut.HTML) != "<p>Dear &lt;Cy&gt;,</p>") {
+		t.Errorf("Unexpected bodies: %q, %q", msgOut.Text, msgOut.HTML)
+	}
+	if (len(base.Headers["To"]) != 1) || (base.Subject != "Test Subject") {
+		t.Errorf("Merge modified the base message")
+	}
+
+	// WITHOUT AN ERROR HANDLER, THE FIRST FAILURE ENDS THE MERGE
+	fs = &fakeServer{rcptCode: map[string]int{"bad@example.com": 550}}
+	pCli = fs.dial(t)
+	defer pCli.Close()
+	if nSent, err = pCli.Merge(tmpl, base, Recipients(sRecips), nil); (nSent != 1) || (err == nil) {
+		t.Errorf("Expected to stop after 1 message, got %d, %v", nSent, err)
+	}
+}
+
+func TestSendResult(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.To = []string{"a@example.com", "bad@example.com"}
+	msgIn.Cc = []string{"c@example.com"}
+	msgIn.Bcc = nil
+
+	// ANY REJECTION FAILS THE SEND BY DEFAULT
+	fs := &fakeServer{rcptCode: map[string]int{"bad@example.com": 550}}
+	pCli := fs.dial(t)
+	pRes, err := pCli.SendWithResult(msgIn)
+	if pErr, ok := err.(*textproto.Error); !ok || (pErr.Code != 550) {
+		t.Errorf("Expected a 550 textproto.Error, got %v", err)
+	}
+	if len(pRes.Recipients) != 3 {
+		t.Fatalf("Expected 3 recipient results, got %+v", pRes.Recipients)
+	}
+	sRej := pRes.Rejected()
+	if (len(sRej) != 1) || (sRej[0].Address != "bad@example.com") || (sRej[0].Code != 550) ||
+		(sRej[0].Enhanced != "5.1.1") || (sRej[0].Text != "rejected <bad@example.com>") {
+		t.Errorf("Unexpected rejections: %+v", sRej)
+	}
+	if st := pRes.Recipients[2]; !st.Accepted || (st.Code != 250) || (st.Enhanced != "2.1.5") || (st.Text != "ok") {
+		t.Errorf("Unexpected status: %+v", st)
+	}
+
+	// ...UNLESS PARTIAL DELIVERY IS ALLOWED
+	pCli.AllowPartial = true
+	if pRes, err = pCli.SendWithResult(msgIn); err != nil {
+		t.Fatal(err)
+	}
+	err = pCli.Send(msgIn)
+	if pErr, ok := err.(*PartialDeliveryError); !ok || (len(pErr.Result.Rejected()) != 1) || !errors.Is(err, ErrPartialDelivery) {
+		t.Errorf("Expected a PartialDeliveryError, got %v", err)
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(pRes.Accepted(), ",") != "a@example.com,c@example.com" {
+		t.Errorf("Unexpected accepted recipients: %q", pRes.Accepted())
+	}
+	if (pRes.Data.Code != 250) || (pRes.Data.Enhanced != "2.0.0") || (pRes.Data.Text != "queued") {
+		t.Errorf("Unexpected DATA reply: %+v", pRes.Data)
+	}
+	if len(fs.data) != 2 {
+		t.Errorf("Expected 2 messages, got %d", len(fs.data))
+	}
+	nRset := 0
+	for _, cmd := range fs.cmds {
+		if cmd == "RSET" {
+			nRset++
+		}
+	}
+	if nRset != 1 {
+		t.Errorf("Expected the rejected transaction to be reset: %q", fs.cmds)
+	}
+}
+
+// writeRecorder records each write to a connection.
+type writeRecorder struct {
+	net.Conn
+	writes []string
+}
+
+func (wr *writeRecorder) Write(p []byte) (int, error) {
+	wr.writes = append(wr.writes, string(p))
+	return wr.Conn.Write(p)
+}
+
+func TestPipelining(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.To = []string{"a@example.com", "bad@example.com", "c@example.com"}
+	msgIn.Cc, msgIn.Bcc = nil, nil
+	msgIn.Text = []byte("Pipelined\r\n")
+
+	fs := &fakeServer{ext: []string{"PIPELINING"}, rcptCode: map[string]int{"bad@example.com": 550}}
+	pCli := fs.dial(t)
+	pRec := &writeRecorder{Conn: pCli.cork.Conn}
+	pCli.cork.Conn = pRec
+
+	// WITHOUT ALLOWPARTIAL, DATA WAITS FOR THE RCPT REPLIES
+	if _, err := pCli.SendWithResult(msgIn); err == nil {
+		t.Error("Expected a rejection")
+	}
+	want := "MAIL FROM:<test@test.com>\r\n" +
+		"RCPT TO:<a@example.com>\r\nRCPT TO:<bad@example.com>\r\nRCPT TO:<c@example.com>\r\n"
+	if (len(pRec.writes) != 2) || (pRec.writes[0] != want) || (pRec.writes[1] != "RSET\r\n") {
+		t.Errorf("Unexpected writes: %q", pRec.writes)
+	}
+
+	// WITH ALLOWPARTIAL, DATA JOINS THE BATCH
+	pRec.writes = nil
+	pCli.AllowPartial = true
+	pRes, err := pCli.SendWithResult(msgIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(pRec.writes) == 0) || (pRec.writes[0] != want+"DATA\r\n") {
+		t.Errorf("Unexpected writes: %q", pRec.writes)
+	}
+	if (strings.Join(pRes.Accepted(), ",") != "a@example.com,c@example.com") || (pRes.Data.Code != 250) {
+		t.Errorf("Unexpected result: %+v", pRes)
+	}
+
+	// NO RECIPIENTS: 354 IS NOT EXPECTED, BUT THE TRANSACTION IS RESET
+	msgIn.To = []string{"bad@example.com"}
+	if _, err = pCli.SendWithResult(msgIn); err == nil {
+		t.Error("Expected a rejection")
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.data) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(fs.data))
+	}
+	msgOut, err := NewEmailFromReader(bytes.NewReader(fs.data[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msgOut.Text, msgIn.Text) {
+		t.Errorf("Incorrect text: %q", msgOut.Text)
+	}
+}
+
+func TestChunking(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Chunked\r\n.\r\n")
+	content := make([]byte, bdatChunkSize+1000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	copy(content, "\r\n.\r\n")
+	msgIn.Attach(bytes.NewReader(content), "big.bin", "")
+
+	fs := &fakeServer{ext: []string{"CHUNKING", "BINARYMIME", "8BITMIME"}}
+	pCli := fs.dial(t)
+	defer pCli.Close()
+
+	for _, bBinary := range []bool{false, true} {
+
+		pCli.BinaryMIME = bBinary
+		fs.cmds, fs.data = nil, nil
+		pRes, err := pCli.SendWithResult(msgIn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = pCli.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		var sBDAT []string
+		for _, cmd := range fs.cmds {
+			if strings.HasPrefix(cmd, "BDAT") || strings.HasPrefix(cmd, "MAIL") {
+				sBDAT = append(sBDAT, cmd)
+			} else if cmd == "DATA" {
+				t.Error("DATA sent to a CHUNKING server")
+			}
+		}
+		wantMail := "MAIL FROM:<test@test.com> BODY=8BITMIME"
+		wantCTE := "base64"
+		if bBinary {
+			wantMail = "MAIL FROM:<test@test.com> BODY=BINARYMIME"
+			wantCTE = "binary"
+		}
+		if (len(sBDAT) < 3) || (sBDAT[0] != wantMail) || (sBDAT[1] != fmt.Sprintf("BDAT %d", bdatChunkSize)) ||
+			!strings.HasSuffix(sBDAT[len(sBDAT)-1], " LAST") || (pRes.Data.Text != "queued") {
+			t.Errorf("Unexpected commands: %q", sBDAT)
+		}
+
+		if len(fs.data) != 1 {
+			t.Fatalf("Expected 1 message, got %d", len(fs.data))
+		}
+		if bytes.Contains(fs.data[0], []byte("\r\n..\r\n")) {
+			t.Error("BDAT content was dot-stuffed")
+		}
+		msgOut, err := NewEmailFromReader(bytes.NewReader(fs.data[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msgOut.Text, msgIn.Text) || (len(msgOut.Attachments) != 1) ||
+			!bytes.Equal(msgOut.Attachments[0].Content, content) {
+			t.Errorf("Message did not survive BDAT")
+		}
+		if cte := msgOut.Attachments[0].Header.Get("Content-Transfer-Encoding"); cte != wantCTE {
+			t.Errorf("Expected %s attachment, got %q", wantCTE, cte)
+		}
+	}
+
+	// CHUNKS ARE LOGGED, AS DATA IS
+	var logBuf bytes.Buffer
+	fs = &fakeServer{ext: []string{"CHUNKING"}}
+	pCli = fs.dialWith(t, TextprotoLogged(log.New(&logBuf, "", 0), false))
+	defer pCli.Close()
+	msgIn = dummyEmail()
+	msgIn.Text = []byte("Chunked\r\n")
+	if err := pCli.Send(msgIn); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logBuf.String(), "BDAT") || !strings.Contains(logBuf.String(), "Chunked") {
+		t.Errorf("BDAT content not logged:\n%s", logBuf.String())
+	}
+}
+
+func TestSizeExtension(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.Text = []byte("Sized\r\n")
+
+	// DECLARED ON MAIL FROM, EXACTLY
+	fs := &fakeServer{ext: []string{"SIZE 1000000"}}
+	pCli := fs.dial(t)
+	err := pCli.Send(msgIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, cmd := range fs.cmds {
+		if strings.HasPrefix(cmd, "MAIL") {
+			fmt.Sscanf(cmd[strings.Index(cmd, "SIZE="):], "SIZE=%d", &size)
+		}
+	}
+	if size != int64(len(fs.data[0])) {
+		t.Errorf("Declared SIZE=%d for a %d octet message", size, len(fs.data[0]))
+	}
+
+	// REFUSED BEFORE MAIL FROM
+	fs = &fakeServer{ext: []string{"SIZE 100"}}
+	pCli = fs.dial(t)
+	defer pCli.Close()
+	err = pCli.Send(msgIn)
+	if pErr, ok := err.(*SizeError); !ok || (pErr.Limit != 100) || (pErr.Size < 100) {
+		t.Fatalf("Expected a SizeError, got %v", err)
+	}
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Error("SizeError is not ErrMessageTooLarge")
+	}
+	if err = pCli.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range fs.cmds {
+		if strings.HasPrefix(cmd, "MAIL") {
+			t.Errorf("Oversized message began a transaction: %q", cmd)
+		}
+	}
+}
+
+func TestDSN(t *testing.T) {
+
+	msgIn := dummyEmail()
+	msgIn.To = []string{"a@example.com", "b@example.com"}
+	msgIn.Cc, msgIn.Bcc = nil, nil
+	msgIn.DSN = &DSN{
+		Return:     DSNReturnHeaders,
+		EnvelopeID: "QQ314159+x=y",
+		Notify:     []string{DSNNotifyFailure, DSNNotifyDelay},
+		Recipients: map[string]DSNRecipient{
+			"b@example.com": {Notify: []string{DSNNotifySuccess}, ORCPT: "b+list@example.com"},
+		},
+	}
+
+	for _, sExt := range [][]string{{"DSN"}, nil} {
+
+		fs := &fakeServer{ext: sExt}
+		pCli := fs.dial(t)
+		if err := pCli.Send(msgIn); err != nil {
+			t.Fatal(err)
+		}
+		if err := pCli.Quit(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{
+			"MAIL FROM:<test@test.com>",
+			"RCPT TO:<a@example.com>",
+			"RCPT TO:<b@example.com>",
+		}
+		if len(sExt) > 0 {
+			want = []string{
+				"MAIL FROM:<test@test.com> RET=HDRS ENVID=QQ314159+2Bx+3Dy",
+				"RCPT TO:<a@example.com> NOTIFY=FAILURE,DELAY",
+				"RCPT TO:<b@example.com> NOTIFY=SUCCESS ORCPT=rfc822;b+2Blist@example.com",
+			}
+		}
+		if (len(fs.cmds) < 4) || (strings.Join(fs.cmds[1:4], "\n") != strings.Join(want, "\n")) {
+			t.Errorf("Expected %q, got %q", want, fs.cmds)
+		}
+	}
+
+	// NEVER STANDS ALONE
+	msgIn.DSN.Notify = []string{DSNNotifyNever, DSNNotifyDelay}
+	if err := (&Client{}).Send(msgIn); err != ErrInvalidDSN {
+		t.Errorf("Expected ErrInvalidDSN, got %v", err)
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+
+	for label, want := range map[string]string{
+		"bücher":            "bcher-kva",
+		"münchen":           "mnchen-3ya",
+		"他们为什么不说中文":         "ihqwcrb4cv8a8dqg056pqjye",
+		"3年B組金八先生":          "3B-ww4c5e180e575a65lsy2b",
+		"ليهمابتكلموشعربي؟": "egbpdaj6bu4bxfgehfvwxn",
+	} {
+		if enc, err := punycode(label); (err != nil) || (enc != want) {
+			t.Errorf("punycode(%q) = %q, %v; want %q", label, enc, err, want)
+		}
+	}
+
+	newMsg := func(to string) *Email {
+		msgIn := dummyEmail()
+		msgIn.To = []string{to}
+		msgIn.Cc, msgIn.Bcc = nil, nil
+		msgIn.Subject = "Grüße"
+		msgIn.Text = []byte("Hallo\r\n")
+		return msgIn
+	}
+	received := func(fs *fakeServer) (string, string) {
+		msgOut, err := mail.ReadMessage(bytes.NewReader(fs.data[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgOut.Header.Get("To"), msgOut.Header.Get("Subject")
+	}
+
+	// WITHOUT SMTPUTF8: PUNYCODE DOMAINS, ENCODED HEADERS
+	fs := &fakeServer{ext: []string{"8BITMIME"}}
+	pCli := fs.dial(t)
+	pRes, err := pCli.SendWithResult(newMsg("Jörg <jorg@bücher.example>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pCli.SendWithResult(newMsg("jörg@example.com")); err != ErrSMTPUTF8Required {
+		t.Errorf("Expected ErrSMTPUTF8Required, got %v", err)
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if (fs.cmds[1] != "MAIL FROM:<test@test.com> BODY=8BITMIME") || (fs.cmds[2] != "RCPT TO:<jorg@xn--bcher-kva.example>") ||
+		(len(fs.cmds) != 5) || (pRes.Recipients[0].Address != "jorg@bücher.example") {
+		t.Errorf("Unexpected commands: %q", fs.cmds)
+	}
+	if to, subject := received(fs); (to != "=?utf-8?q?J=C3=B6rg?= <jorg@xn--bcher-kva.example>") || (subject != "=?UTF-8?q?Gr=C3=BC=C3=9Fe?=") {
+		t.Errorf("Unexpected headers: %q, %q", to, subject)
+	}
+
+	// WITH SMTPUTF8: RAW UTF-8
+	fs = &fakeServer{ext: []string{"8BITMIME", "SMTPUTF8"}}
+	pCli = fs.dial(t)
+	if err = pCli.Send(newMsg("Jörg <jörg@bücher.example>")); err != nil {
+		t.Fatal(err)
+	}
+	if err = pCli.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if (fs.cmds[1] != "MAIL FROM:<test@test.com> BODY=8BITMIME SMTPUTF8") || (fs.cmds[2] != "RCPT TO:<jörg@bücher.example>") {
+		t.Errorf("Unexpected commands: %q", fs.cmds)
+	}
+	if to, subject := received(fs); (to != "Jörg <jörg@bücher.example>") || (subject != "Grüße") {
+		t.Errorf("Unexpected headers: %q, %q", to, subject)
+	}
+
+	// PUBLIC Mail & Rcpt, AND INTERNATIONALIZED ORCPT
+	for _, sExt := range [][]string{{"DSN"}, {"DSN", "SMTPUTF8"}} {
+		fs = &fakeServer{ext: sExt}
+		pCli = fs.dial(t)
+		for _, from := range []string{"test@test.com", "test@bücher.example"} {
+			if err = pCli.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if err = pCli.Mail(from); err != nil {
+				t.Fatal(err)
+			}
+			if err = pCli.Rcpt("jorg@bücher.example"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		errRcpt := pCli.Rcpt("jörg@example.com")
+		if err = pCli.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		msgIn := newMsg("jorg@bücher.example")
+		msgIn.DSN = &DSN{Recipients: map[string]DSNRecipient{"jorg@bücher.example": {ORCPT: "jörg+x@example.com"}}}
+		if err = pCli.Send(msgIn); err != nil {
+			t.Fatal(err)
+		}
+		if err = pCli.Quit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// NOTE: SMTPUTF8 only for an internationalized sender, as with Send
+		want := []string{"RSET", "MAIL FROM:<test@test.com>", "RCPT TO:<jorg@xn--bcher-kva.example>",
+			"RSET", "MAIL FROM:<test@xn--bcher-kva.example>", "RCPT TO:<jorg@xn--bcher-kva.example>", "RSET",
+			"MAIL FROM:<test@test.com>", `RCPT TO:<jorg@xn--bcher-kva.example> ORCPT=utf-8;j\x{F6}rg\x{2B}x@example.com`}
+		if len(sExt) > 1 {
+			want = []string{"RSET", "MAIL FROM:<test@test.com>", "RCPT TO:<jorg@xn--bcher-kva.example>",
+				"RSET", "MAIL FROM:<test@bücher.example> SMTPUTF8", "RCPT TO:<jorg@bücher.example>", "RCPT TO:<jörg@example.com>", "RSET",
+				"MAIL FROM:<test@test.com> SMTPUTF8", `RCPT TO:<jorg@bücher.example> ORCPT=utf-8;jörg\x{2B}x@example.com`}
+		} else if errRcpt != ErrSMTPUTF8Required {
+			t.Errorf("Expected ErrSMTPUTF8Required, got %v", errRcpt)
+		}
+		if (len(fs.cmds) < len(want)+1) || (strings.Join(fs.cmds[1:len(want)+1], "\n") != strings.Join(want, "\n")) {
+			t.Errorf("Expected %q, got %q", want, fs.cmds)
+		}
+	}
+}
+
 func TestSend(t *testing.T) {
 
 	var err error
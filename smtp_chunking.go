@@ -0,0 +1,71 @@
+package email
+
+import "bytes"
+
+// bdatChunkSize is the size of the BDAT chunks a message is sent in.
+const bdatChunkSize = 1 << 20
+
+/*
+bdatWriter sends a message in BDAT chunks, per RFC 3030 (CHUNKING), in place
+of DATA: there is no dot-stuffing, and the content may be binary.  Closing it
+sends the last chunk.
+*/
+type bdatWriter struct {
+	c     *Client
+	buf   bytes.Buffer
+	reply SMTPReply // reply to the latest chunk
+	err   error
+}
+
+func (bw *bdatWriter) Write(p []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	bw.buf.Write(p)
+	for (bw.err == nil) && (bw.buf.Len() >= bdatChunkSize) {
+		bw.err = bw.chunk(bw.buf.Next(bdatChunkSize), false)
+	}
+	return len(p), bw.err
+}
+
+func (bw *bdatWriter) Close() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	bw.err = bw.chunk(bw.buf.Bytes(), true)
+	bw.buf.Reset()
+	return bw.err
+}
+
+// chunk sends `data` with a single BDAT command, and reads the reply.
+func (bw *bdatWriter) chunk(data []byte, bLast bool) error {
+
+	c := bw.c
+	cmdStr := "BDAT %d"
+	if bLast {
+		cmdStr += " LAST"
+	}
+
+	// THE COMMAND & ITS DATA GO OUT TOGETHER
+	// NOTE: the data is written beneath c.Text, so it is logged separately
+	c.cork.corked = true
+	id, err := c.Text.Cmd(cmdStr, len(data))
+	if err == nil {
+		if dl, ok := c.Text.(dataLogger); ok {
+			dl.logData(data)
+		}
+		_, err = c.cork.Write(data)
+	}
+	if eU := c.cork.uncork(); err == nil {
+		err = eU
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	code, msg, err := c.Text.ReadResponse(250)
+	bw.reply = newSMTPReply(code, msg)
+	return err
+}
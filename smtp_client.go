@@ -7,11 +7,12 @@ package email
 import (
 	"crypto/tls"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/mail"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,9 +22,15 @@ Client implements the Simple Mail Transfer Protocol as defined in RFC 5321.
 
 It also implements the following extensions:
 
-	8BITMIME  RFC 1652
-	AUTH      RFC 2554
-	STARTTLS  RFC 3207
+	8BITMIME    RFC 1652
+	AUTH        RFC 2554
+	BINARYMIME  RFC 3030
+	CHUNKING    RFC 3030
+	DSN         RFC 3461
+	PIPELINING  RFC 2920
+	SIZE        RFC 1870
+	SMTPUTF8    RFC 6531
+	STARTTLS    RFC 3207
 
 Additional extensions may be handled by clients.
 */
@@ -39,6 +46,9 @@ type Client struct {
 	// connection later
 	conn net.Conn
 
+	// conn, as given to fnNewTextproto, for batching pipelined commands
+	cork *corkConn
+
 	serverName string
 
 	// map of supported extensions
@@ -50,8 +60,21 @@ type Client struct {
 	localName  string // the name to use in HELO/EHLO
 	didHello   bool   // whether we've said HELO/EHLO
 	helloError error  // the error from the hello
+	bUTF8Txn   bool   // whether the transaction begun by Mail declared SMTPUTF8
 
 	TimeoutMsec uint32
+
+	// DKIM signs each message sent, if set.
+	DKIM *DKIMSigner
+
+	// AllowPartial lets Send deliver a message when some (but not all) of its
+	// recipients are rejected; see SendWithResult.
+	AllowPartial bool
+
+	// BinaryMIME lets Send write attachments unencoded (Content-Transfer-Encoding:
+	// binary) when the server offers both CHUNKING and BINARYMIME.  Messages
+	// that are signed (DKIM, S/MIME or OpenPGP) are always encoded.
+	BinaryMIME bool
 }
 
 // Close closes the connection.
@@ -145,7 +168,8 @@ func (c *Client) StartTLS(config *tls.Config) error {
 		return err
 	}
 	c.conn = tls.Client(c.conn, config)
-	c.Text = c.fnNewTextproto(c.conn)
+	c.cork = &corkConn{Conn: c.conn}
+	c.Text = c.fnNewTextproto(c.cork)
 	return c.ehlo()
 }
 
@@ -197,7 +221,9 @@ func (c *Client) Auth(a Auth) error {
 
 // Mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
-// parameter.
+// parameter.  An internationalized address is sent as SendWithResult would:
+// with the SMTPUTF8 parameter if the server supports it, or else with its
+// domain converted to punycode.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
 func (c *Client) Mail(from string) error {
 	if err := validateLine(from); err != nil {
@@ -206,35 +232,157 @@ func (c *Client) Mail(from string) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	cmdStr := "MAIL FROM:<%s>"
-	if c.ext != nil {
+	t := &mailTxn{from: from}
+	if err := c.intlOptions(t, []string{from}); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(250, "%s", c.mailCmd(t))
+	c.bUTF8Txn = t.bUTF8
+	return err
+}
+
+// mailTxn is a mail transaction in progress, in SendWithResult.
+type mailTxn struct {
+	from    string
+	to      []*mail.Address
+	res     *SendResult
+	bChunk  bool  // send the message by BDAT, rather than DATA
+	bBinary bool  // the message has unencoded (binary) parts
+	size    int64 // message size declared with SIZE, if > 0
+	dsn     *DSN  // DSN parameters, if the server offers DSN
+	bUTF8   bool  // SMTPUTF8: addresses & headers are raw UTF-8
+	bASCII  bool  // addresses need converting to ASCII (see asciiAddress)
+}
+
+// writeOpts are the options for rendering the transaction's message.
+func (t *mailTxn) writeOpts() writeOpts {
+	return writeOpts{bBinary: t.bBinary, bUTF8: t.bUTF8}
+}
+
+// addr is an envelope address as sent; conversion errors are caught by
+// SendWithResult before the transaction starts.
+func (t *mailTxn) addr(addr string) string {
+	if t.bASCII {
+		if ascii, err := asciiAddress(addr); err == nil {
+			return ascii
+		}
+	}
+	return addr
+}
+
+/*
+intlOptions decides how transaction `t` carries `sAddrs`, its envelope
+addresses.  Internationalized (non-ASCII) addresses need SMTPUTF8, or else
+(for domains) punycode, in which case any that cannot be converted return
+ErrSMTPUTF8Required.
+*/
+func (c *Client) intlOptions(t *mailTxn, sAddrs []string) error {
+
+	bIntl := false
+	for _, addr := range sAddrs {
+		bIntl = bIntl || !isASCII(addr)
+	}
+	if !bIntl {
+		return nil
+	}
+	if bSMTPUTF8, _ := c.Extension("SMTPUTF8"); bSMTPUTF8 {
+		t.bUTF8 = true
+		return nil
+	}
+	t.bASCII = true
+	for _, addr := range sAddrs {
+		if _, E := asciiAddress(addr); E != nil {
+			return E
+		}
+	}
+	return nil
+}
+
+// mailCmd is the MAIL command, with parameters for the extensions in use.
+func (c *Client) mailCmd(t *mailTxn) string {
+	cmdStr := "MAIL FROM:<" + t.addr(t.from) + ">"
+	if t.bBinary {
+		cmdStr += " BODY=BINARYMIME"
+	} else if c.ext != nil {
 		if _, ok := c.ext["8BITMIME"]; ok {
 			cmdStr += " BODY=8BITMIME"
 		}
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	if t.size > 0 {
+		cmdStr += " SIZE=" + strconv.FormatInt(t.size, 10)
+	}
+	if t.bUTF8 {
+		cmdStr += " SMTPUTF8"
+	}
+	if t.dsn != nil {
+		cmdStr += t.dsn.mailParams()
+	}
+	return cmdStr
+}
+
+// rcptCmd is the RCPT command for `to`, with parameters for the extensions in use.
+func (c *Client) rcptCmd(t *mailTxn, to string) string {
+	cmdStr := "RCPT TO:<" + t.addr(to) + ">"
+	if t.dsn != nil {
+		cmdStr += t.dsn.rcptParams(to, t.bUTF8)
+	}
+	return cmdStr
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
+// Unless Mail declared SMTPUTF8, an internationalized domain is converted to
+// punycode, and a non-ASCII local part returns ErrSMTPUTF8Required.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
 func (c *Client) Rcpt(to string) error {
 	if err := validateLine(to); err != nil {
 		return err
 	}
+	if !c.bUTF8Txn {
+		var err error
+		if to, err = asciiAddress(to); err != nil {
+			return err
+		}
+	}
 	_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
 	return err
 }
 
+/*
+addRcpt records the reply to RCPT TO for `to` in `pRes`.  A rejection is
+returned as `errReply`, and leaves the transaction open; `errFail` is any other
+failure.
+*/
+func (pRes *SendResult) addRcpt(to string, code int, msg string, err error) (errReply, errFail error) {
+	if pErr, ok := err.(*textproto.Error); ok {
+		errReply = pErr
+	} else if err != nil {
+		return nil, err
+	}
+	pRes.Recipients = append(pRes.Recipients, RcptStatus{
+		Address:   to,
+		Accepted:  errReply == nil,
+		SMTPReply: newSMTPReply(code, msg),
+	})
+	return errReply, nil
+}
+
+// bAbort reports whether recipient rejections abort the transaction (see
+// SendWithResult).
+func (c *Client) bAbort(pRes *SendResult, errRejected error) bool {
+	return (errRejected != nil) && (!c.AllowPartial || (len(pRes.Accepted()) == 0))
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
+	reply SMTPReply // final reply, once closed
 }
 
 func (d *dataCloser) Close() error {
 	d.WriteCloser.Close()
-	_, _, err := d.c.Text.ReadResponse(250)
+	code, msg, err := d.c.Text.ReadResponse(250)
+	d.reply = newSMTPReply(code, msg)
 	return err
 }
 
@@ -247,7 +395,7 @@ func (c *Client) Data() (io.WriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter()}, nil
+	return &dataCloser{c: c, WriteCloser: c.Text.DotWriter()}, nil
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -341,54 +489,213 @@ func TLSConfig(hostName string) *tls.Config {
 	}
 }
 
-// Send an e-mail using the established SMTP session.
+/*
+Send an e-mail using the established SMTP session.  It is SendWithResult,
+without the result, except that a message sent to only some of its recipients
+(see Client.AllowPartial) returns a *PartialDeliveryError.
+*/
 func (c *Client) Send(e *Email) error {
+	pRes, E := c.SendWithResult(e)
+	if (E == nil) && (len(pRes.Rejected()) > 0) {
+		return &PartialDeliveryError{Result: pRes}
+	}
+	return E
+}
+
+/*
+SendWithResult sends an e-mail using the established SMTP session, and reports
+the server's reply to each recipient.
+
+Every recipient is tried.  If any are rejected, the transaction is aborted
+(with RSET), and the *textproto.Error of the first rejection is returned along
+with the result, unless Client.AllowPartial is set and at least one recipient
+was accepted, in which case the message is sent to those accepted, and nil is
+returned (check SendResult.Rejected).
+A refused DATA command also aborts the transaction, so the session remains
+usable for the next message.
+
+If the server offers PIPELINING, the envelope commands are batched rather than
+sent one round trip at a time (see pipelineEnvelope).
+
+Internationalized (non-ASCII) addresses are sent with SMTPUTF8, and the
+message headers as raw UTF-8, if the server offers it.  Otherwise, their
+domains are converted to punycode; a non-ASCII local part then returns
+ErrSMTPUTF8Required.  Results report addresses as given, either way.
+
+If the server offers SIZE, the message is measured first, and declared with
+MAIL FROM; a message over the server's limit returns a *SizeError without
+anything being sent.  Measuring renders the message an extra time, so lazy
+attachments (see AttachLazy) are opened twice.
+
+The message is streamed to the server with Email.WriteTo, rather than rendered
+in memory first (unless it is to be DKIM signed).  If rendering fails partway
+through DATA, the transaction is left unfinished, and the Client should be
+closed.
+*/
+func (c *Client) SendWithResult(e *Email) (*SendResult, error) {
+
+	pRes := &SendResult{}
 
 	// PARSE/VERIFY ADDRESSES
 	to, E := e.ParseToFromAddrs()
 	if E != nil {
-		return E
+		return pRes, E
 	}
 
 	sender, E := e.ParseSender()
 	if E != nil {
-		return E
+		return pRes, E
 	}
 
-	// MESSAGE-TO-BYTESTREAM
-	raw, E := e.Bytes()
-	if E != nil {
-		return E
+	if e.DSN != nil {
+		if E = e.DSN.validate(); E != nil {
+			return pRes, E
+		}
+	}
+
+	// DKIM SIGNATURES COVER THE WHOLE BODY, SO SIGNED MESSAGES ARE RENDERED UP FRONT
+	var signed []byte
+	if c.DKIM != nil {
+		raw, E := e.Bytes()
+		if E != nil {
+			return pRes, E
+		}
+		if signed, E = c.DKIM.Sign(raw); E != nil {
+			return pRes, E
+		}
+	}
+
+	// TRANSACTION OPTIONS
+	t := &mailTxn{from: sender.Address, to: to, res: pRes}
+	if bChunk, _ := c.Extension("CHUNKING"); bChunk && (c.cork != nil) {
+		t.bChunk = true
+		bBinMIME, _ := c.Extension("BINARYMIME")
+		t.bBinary = bBinMIME && c.BinaryMIME && (signed == nil) && (e.SMIME == nil) && (e.OpenPGP == nil)
+	}
+
+	sAddrs := []string{t.from}
+	for _, addrRecip := range to {
+		sAddrs = append(sAddrs, addrRecip.Address)
+	}
+	if E = c.intlOptions(t, sAddrs); E != nil {
+		return pRes, E
+	}
+
+	if e.DSN != nil {
+		if bDSN, _ := c.Extension("DSN"); bDSN {
+			t.dsn = e.DSN
+		}
+	}
+
+	// SIZE: CHECK THE MESSAGE AGAINST THE SERVER'S LIMIT BEFORE SENDING ANY OF IT
+	if bSize, szLimit := c.Extension("SIZE"); bSize {
+		if signed != nil {
+			t.size = int64(len(signed))
+		} else {
+			// FIX THE GENERATED HEADERS, SO THAT THE MESSAGE SENT IS THE ONE MEASURED
+			if e, E = e.withGeneratedHeaders(); E != nil {
+				return pRes, E
+			}
+			if t.size, E = e.writeTo(io.Discard, t.writeOpts()); E != nil {
+				return pRes, E
+			}
+		}
+		limit, _ := strconv.ParseInt(strings.TrimSpace(szLimit), 10, 64)
+		if (limit > 0) && (t.size > limit) {
+			return pRes, &SizeError{Size: t.size, Limit: limit}
+		}
 	}
 
 	// COMMS TIMEOUT
 	if c.TimeoutMsec > 0 {
 		dTimeout := time.Millisecond * time.Duration(c.TimeoutMsec)
 		if E = c.conn.SetDeadline(time.Now().Add(dTimeout)); E != nil {
-			return E
+			return pRes, E
 		}
 	}
 
-	// CMD: SENDER & RECIPIENTS
-	if E = c.Mail(sender.Address); E != nil {
-		return E
+	// CMD: SENDER, RECIPIENTS & DATA
+	var w io.WriteCloser
+	if bPipe, _ := c.Extension("PIPELINING"); bPipe {
+		w, E = c.pipelineEnvelope(t)
+	} else {
+		w, E = c.envelope(t)
+	}
+	if E != nil {
+		return pRes, E
 	}
 
-	for _, addrRecip := range to {
-		if E = c.Rcpt(addrRecip.Address); E != nil {
-			return E
+	// STREAM MESSAGE TO SERVER
+	if signed != nil {
+		_, E = w.Write(signed)
+	} else {
+		_, E = e.writeTo(w, t.writeOpts())
+	}
+	if E != nil {
+		// NOTE: closing `w` would end DATA, and deliver a truncated message.
+		// the session is left mid-transaction, and should be abandoned.
+		return pRes, E
+	}
+	E = w.Close()
+	switch w := w.(type) {
+	case *dataCloser:
+		pRes.Data = w.reply
+	case *bdatWriter:
+		pRes.Data = w.reply
+	}
+	return pRes, E
+}
+
+// envelope starts a mail transaction one command at a time, up to DATA (or BDAT).
+func (c *Client) envelope(t *mailTxn) (io.WriteCloser, error) {
+
+	// VALIDATE FIRST, SO THAT A BAD ADDRESS LEAVES NO TRANSACTION OPEN
+	if E := validateLine(t.from); E != nil {
+		return nil, E
+	}
+	for _, addrRecip := range t.to {
+		if E := validateLine(addrRecip.Address); E != nil {
+			return nil, E
 		}
 	}
+	if _, _, E := c.cmd(250, "%s", c.mailCmd(t)); E != nil {
+		return nil, E
+	}
 
-	// CMD: DATA
-	w, E := c.Data()
-	if E != nil {
-		return E
+	var errRejected error
+	for _, addrRecip := range t.to {
+		code, msg, E := c.cmd(25, "%s", c.rcptCmd(t, addrRecip.Address))
+		errReply, E := t.res.addRcpt(addrRecip.Address, code, msg, E)
+		if E != nil {
+			return nil, E
+		}
+		if errRejected == nil {
+			errRejected = errReply
+		}
+	}
+	if c.bAbort(t.res, errRejected) {
+		if E := c.Reset(); E != nil {
+			return nil, E
+		}
+		return nil, errRejected
 	}
 
-	// WRITE DATA BYTES TO SERVER
-	_, E = w.Write(raw)
-	return errors.Join(E, w.Close())
+	return c.startData(t)
+}
+
+// startData begins sending the message of a transaction, by DATA or BDAT.  If
+// the server refuses DATA, the transaction is reset.
+func (c *Client) startData(t *mailTxn) (io.WriteCloser, error) {
+	if t.bChunk {
+		return &bdatWriter{c: c}, nil
+	}
+	w, E := c.Data()
+	if _, ok := E.(*textproto.Error); ok {
+		if eR := c.Reset(); eR != nil {
+			return nil, eR
+		}
+	}
+	return w, E
 }
 
 // IsTLS returns whether the underlying connection is a tls.Conn.
@@ -431,7 +738,8 @@ func NewClient(
 		fnNewTextproto = textprotoFromConn
 	}
 
-	iTextproto := fnNewTextproto(iConn)
+	pCork := &corkConn{Conn: iConn}
+	iTextproto := fnNewTextproto(pCork)
 	_, _, E = iTextproto.ReadResponse(220)
 	if E != nil {
 		iTextproto.Close()
@@ -442,6 +750,7 @@ func NewClient(
 		Text:           iTextproto,
 		fnNewTextproto: fnNewTextproto,
 		conn:           iConn,
+		cork:           pCork,
 		serverName:     serverName,
 		localName:      "localhost",
 	}
@@ -50,15 +50,18 @@ func (mode *SMTPClientMode) UnmarshalJSON(val []byte) error {
 
 // SMTPClientConfig holds parameters for connecting to an SMTP server.
 type SMTPClientConfig struct {
-	Server      string
-	Port        uint16
-	Username    string
-	Password    string
-	Mode        SMTPClientMode
-	TimeoutMsec uint32
-	Proto       string // dial protocol: `tcp`, `tcp4`, or `tcp6`; defaults to `tcp`
-	SMTPLog     string // path to SMTP log: complete filepath, "-" for STDOUT, or empty to disable SMTP logging
-	KeepAlive   net.KeepAliveConfig
+	Server       string
+	Port         uint16
+	Username     string
+	Password     string
+	Mode         SMTPClientMode
+	TimeoutMsec  uint32
+	Proto        string // dial protocol: `tcp`, `tcp4`, or `tcp6`; defaults to `tcp`
+	SMTPLog      string // path to SMTP log: complete filepath, "-" for STDOUT, or empty to disable SMTP logging
+	KeepAlive    net.KeepAliveConfig
+	DKIM         *DKIMSigner `json:"-"` // DKIM signs each message sent, if set
+	AllowPartial bool        // send to the accepted recipients when others are rejected (see Client.SendWithResult)
+	BinaryMIME   bool        // send attachments unencoded, when the server allows (see Client.BinaryMIME)
 }
 
 // Dial to an SMTP server & establish an SMTP session per settings
@@ -148,6 +151,9 @@ func (cfg SMTPClientConfig) Dial() (*Client, error) {
 		return nil, err
 	}
 	pCli.TimeoutMsec = cfg.TimeoutMsec
+	pCli.DKIM = cfg.DKIM
+	pCli.AllowPartial = cfg.AllowPartial
+	pCli.BinaryMIME = cfg.BinaryMIME
 	return pCli, nil
 }
 
@@ -0,0 +1,143 @@
+package email
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DSN RET values: how much of a message to return with a failure notice.
+const (
+	DSNReturnFull    = "FULL" // the whole message
+	DSNReturnHeaders = "HDRS" // the message headers only
+)
+
+// DSN NOTIFY values: when to send a notification for a recipient.
+const (
+	DSNNotifyNever   = "NEVER" // must be alone
+	DSNNotifySuccess = "SUCCESS"
+	DSNNotifyFailure = "FAILURE"
+	DSNNotifyDelay   = "DELAY"
+)
+
+/*
+DSN requests Delivery Status Notifications for a message, per RFC 3461.  Set
+Email.DSN, and Client.Send will add the parameters to MAIL FROM and RCPT TO
+when the server offers the DSN extension (they are left off otherwise).
+
+Empty values leave the choice to the server.
+*/
+type DSN struct {
+	Return     string   // RET: DSNReturnFull or DSNReturnHeaders
+	EnvelopeID string   // ENVID: an identifier for the message, returned in notifications
+	Notify     []string // NOTIFY for each recipient: DSNNotify... values
+
+	// per-recipient settings, by address, overriding Notify
+	Recipients map[string]DSNRecipient
+}
+
+// DSNRecipient holds the DSN settings for one recipient.
+type DSNRecipient struct {
+	Notify []string // NOTIFY: DSNNotify... values
+	ORCPT  string   // original recipient address, if it differs (e.g. before forwarding)
+}
+
+// validate checks for RET & NOTIFY values that RFC 3461 does not allow.
+func (d *DSN) validate() error {
+
+	switch d.Return {
+	case "", DSNReturnFull, DSNReturnHeaders:
+	default:
+		return ErrInvalidDSN
+	}
+
+	sNotify := [][]string{d.Notify}
+	for _, r := range d.Recipients {
+		sNotify = append(sNotify, r.Notify)
+	}
+	for _, sN := range sNotify {
+		for _, v := range sN {
+			switch v {
+			case DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelay:
+			case DSNNotifyNever:
+				if len(sN) > 1 {
+					return ErrInvalidDSN
+				}
+			default:
+				return ErrInvalidDSN
+			}
+		}
+	}
+	return nil
+}
+
+// mailParams are the DSN parameters of MAIL FROM.
+func (d *DSN) mailParams() string {
+	var sb strings.Builder
+	if len(d.Return) > 0 {
+		sb.WriteString(" RET=" + d.Return)
+	}
+	if len(d.EnvelopeID) > 0 {
+		sb.WriteString(" ENVID=" + xtext(d.EnvelopeID))
+	}
+	return sb.String()
+}
+
+/*
+rcptParams are the DSN parameters of RCPT TO for `addr`.  An internationalized
+ORCPT is given the RFC 6533 "utf-8" address type, as raw UTF-8 if the
+transaction is `bUTF8` (SMTPUTF8).
+*/
+func (d *DSN) rcptParams(addr string, bUTF8 bool) string {
+
+	var sb strings.Builder
+	sNotify := d.Notify
+	r, ok := d.Recipients[addr]
+	if ok && (len(r.Notify) > 0) {
+		sNotify = r.Notify
+	}
+	if len(sNotify) > 0 {
+		sb.WriteString(" NOTIFY=" + strings.Join(sNotify, ","))
+	}
+	if (len(r.ORCPT) > 0) && isASCII(r.ORCPT) {
+		sb.WriteString(" ORCPT=rfc822;" + xtext(r.ORCPT))
+	} else if len(r.ORCPT) > 0 {
+		sb.WriteString(" ORCPT=utf-8;" + utf8AddrText(r.ORCPT, bUTF8))
+	}
+	return sb.String()
+}
+
+// xtext encodes `s` per RFC 3461 section 4: "+", "=", and octets outside
+// of "!" through "~" become "+XX".
+func xtext(s string) string {
+	var sb strings.Builder
+	for ix := 0; ix < len(s); ix++ {
+		ch := s[ix]
+		if (ch < '!') || (ch > '~') || (ch == '+') || (ch == '=') {
+			sb.WriteString("+" + strings.ToUpper(strconv.FormatUint(uint64(ch)|0x100, 16)[1:]))
+		} else {
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
+/*
+utf8AddrText encodes `s` per RFC 6533 section 3: as utf-8-addr-unitext if
+`bUTF8`, or else as utf-8-addr-xtext.  "+", "=", "\", characters outside of
+"!" through "~", and (for xtext) all non-ASCII characters become "\x{HEX}".
+*/
+func utf8AddrText(s string, bUTF8 bool) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if ((r >= '!') && (r <= '~') && (r != '+') && (r != '=') && (r != '\\')) || (bUTF8 && (r >= 0x80)) {
+			sb.WriteRune(r)
+		} else {
+			hex := strings.ToUpper(strconv.FormatUint(uint64(r), 16))
+			if len(hex) < 2 {
+				hex = "0" + hex
+			}
+			sb.WriteString(`\x{` + hex + "}")
+		}
+	}
+	return sb.String()
+}
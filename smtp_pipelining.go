@@ -0,0 +1,147 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/textproto"
+)
+
+/*
+corkConn holds back writes while corked, so that a batch of pipelined commands
+(each flushed by textproto) reaches the network in a single write.
+*/
+type corkConn struct {
+	net.Conn
+	buf    bytes.Buffer
+	corked bool
+}
+
+func (cc *corkConn) Write(p []byte) (int, error) {
+	if cc.corked {
+		return cc.buf.Write(p)
+	}
+	return cc.Conn.Write(p)
+}
+
+// uncork writes out anything held back, and stops holding back writes.
+func (cc *corkConn) uncork() error {
+	cc.corked = false
+	if cc.buf.Len() == 0 {
+		return nil
+	}
+	_, err := cc.Conn.Write(cc.buf.Bytes())
+	cc.buf.Reset()
+	return err
+}
+
+/*
+pipelineEnvelope starts a mail transaction per RFC 2920: MAIL, every RCPT and
+(if Client.AllowPartial is set) DATA are sent in one write, then their replies
+are read in order.
+
+Without AllowPartial, DATA waits for the RCPT replies: once the server has
+answered DATA with 354, the transaction cannot be aborted without sending the
+message to the recipients it accepted.  BDAT always waits, for the same reason.
+*/
+func (c *Client) pipelineEnvelope(t *mailTxn) (io.WriteCloser, error) {
+
+	// VALIDATE FIRST: NOTHING CAN BE TAKEN BACK ONCE SENT
+	if E := validateLine(t.from); E != nil {
+		return nil, E
+	}
+	for _, addrRecip := range t.to {
+		if E := validateLine(addrRecip.Address); E != nil {
+			return nil, E
+		}
+	}
+	bData := c.AllowPartial && !t.bChunk
+
+	// BATCH COMMANDS
+	sIDs := make([]uint, 0, len(t.to)+2)
+	send := func(format string, args ...interface{}) error {
+		id, E := c.Text.Cmd(format, args...)
+		sIDs = append(sIDs, id)
+		return E
+	}
+	if c.cork != nil {
+		c.cork.corked = true
+	}
+	E := send("%s", c.mailCmd(t))
+	for ix := 0; (E == nil) && (ix < len(t.to)); ix++ {
+		E = send("%s", c.rcptCmd(t, t.to[ix].Address))
+	}
+	if (E == nil) && bData {
+		E = send("DATA")
+	}
+	if c.cork != nil {
+		if eU := c.cork.uncork(); E == nil {
+			E = eU
+		}
+	}
+	if E != nil {
+		return nil, E
+	}
+
+	// READ REPLIES, IN ORDER
+	reply := func(id uint, expectCode int) (int, string, error) {
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		return c.Text.ReadResponse(expectCode)
+	}
+
+	_, _, errMail := reply(sIDs[0], 250)
+	if _, ok := errMail.(*textproto.Error); (errMail != nil) && !ok {
+		return nil, errMail
+	}
+
+	var errRejected error
+	for ix, addrRecip := range t.to {
+		code, msg, E := reply(sIDs[ix+1], 25)
+		errReply, E := t.res.addRcpt(addrRecip.Address, code, msg, E)
+		if E != nil {
+			return nil, E
+		}
+		if errRejected == nil {
+			errRejected = errReply
+		}
+	}
+	bAbort := (errMail != nil) || c.bAbort(t.res, errRejected)
+
+	var w io.WriteCloser
+	if bData {
+		code, _, errData := reply(sIDs[len(sIDs)-1], 354)
+		if _, ok := errData.(*textproto.Error); (errData != nil) && !ok {
+			return nil, errData
+		}
+		if code == 354 {
+			w = &dataCloser{c: c, WriteCloser: c.Text.DotWriter()}
+		}
+		if (errData != nil) && !bAbort {
+			if E = c.Reset(); E != nil {
+				return nil, E
+			}
+			return nil, errData
+		}
+	}
+
+	if bAbort {
+		if w != nil {
+			// NOTE: DATA was accepted without any recipients to deliver to,
+			// so an empty message is harmless
+			w.Close()
+		}
+		if E = c.Reset(); E != nil {
+			return nil, E
+		}
+		if errMail != nil {
+			return nil, errMail
+		}
+		return nil, errRejected
+	}
+
+	if w == nil {
+		return c.startData(t)
+	}
+	return w, nil
+}
@@ -0,0 +1,86 @@
+package email
+
+import "strings"
+
+// SMTPReply is a server's reply to an SMTP command.
+type SMTPReply struct {
+	Code     int    // reply code, e.g. 550
+	Enhanced string // RFC 3463 enhanced status code, e.g. "5.1.1", if given
+	Text     string // reply text, less any enhanced status codes
+}
+
+/*
+newSMTPReply splits RFC 3463 enhanced status codes from the text of a reply, as
+returned by textproto.Reader.ReadResponse.  Each line of a multi-line reply
+repeats the code.
+*/
+func newSMTPReply(code int, msg string) SMTPReply {
+
+	r := SMTPReply{Code: code}
+	sLines := strings.Split(msg, "\n")
+	for ix, line := range sLines {
+		enh := line
+		if ixSp := strings.IndexByte(line, ' '); ixSp >= 0 {
+			enh = line[:ixSp]
+		}
+		if !isEnhancedCode(enh) {
+			continue
+		}
+		if len(r.Enhanced) == 0 {
+			r.Enhanced = enh
+		}
+		sLines[ix] = strings.TrimLeft(line[len(enh):], " ")
+	}
+	r.Text = strings.Join(sLines, "\n")
+	return r
+}
+
+// isEnhancedCode reports whether `s` is an enhanced status code: class.subject.detail.
+func isEnhancedCode(s string) bool {
+
+	sParts := strings.Split(s, ".")
+	if (len(sParts) != 3) || (len(sParts[0]) != 1) || (strings.IndexByte("245", sParts[0][0]) < 0) {
+		return false
+	}
+	for _, part := range sParts[1:] {
+		if (len(part) == 0) || (len(part) > 3) || (strings.Trim(part, "0123456789") != "") {
+			return false
+		}
+	}
+	return true
+}
+
+// RcptStatus is the server's reply to RCPT TO for one recipient.
+type RcptStatus struct {
+	Address  string
+	Accepted bool
+	SMTPReply
+}
+
+// SendResult reports the outcome of Client.SendWithResult.
+type SendResult struct {
+	Recipients []RcptStatus // in the order sent
+	Data       SMTPReply    // final reply to DATA, once the message is sent
+}
+
+// Accepted lists the addresses of the recipients the server accepted.
+func (r *SendResult) Accepted() []string {
+	var ret []string
+	for _, st := range r.Recipients {
+		if st.Accepted {
+			ret = append(ret, st.Address)
+		}
+	}
+	return ret
+}
+
+// Rejected lists the recipients the server rejected.
+func (r *SendResult) Rejected() []RcptStatus {
+	var ret []RcptStatus
+	for _, st := range r.Recipients {
+		if !st.Accepted {
+			ret = append(ret, st)
+		}
+	}
+	return ret
+}
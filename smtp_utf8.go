@@ -0,0 +1,158 @@
+package email
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// isASCII reports whether `s` is entirely 7-bit.
+func isASCII(s string) bool {
+	for ix := 0; ix < len(s); ix++ {
+		if s[ix] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+asciiAddress converts the domain of an internationalized address to punycode
+(an IDNA A-label), for servers without SMTPUTF8.  Addresses with a non-ASCII
+local part have no such form, and return ErrSMTPUTF8Required.
+*/
+func asciiAddress(addr string) (string, error) {
+	if isASCII(addr) {
+		return addr, nil
+	}
+	ixAt := strings.LastIndexByte(addr, '@')
+	if (ixAt < 0) || !isASCII(addr[:ixAt]) {
+		return "", ErrSMTPUTF8Required
+	}
+	domain, err := asciiDomain(addr[ixAt+1:])
+	if err != nil {
+		return "", err
+	}
+	return addr[:ixAt+1] + domain, nil
+}
+
+/*
+asciiDomain converts each non-ASCII label of a domain to punycode, per RFC
+3490 ToASCII.  Labels are lowercased, but no other IDNA mapping or validation
+is done.
+*/
+func asciiDomain(domain string) (string, error) {
+
+	// IDEOGRAPHIC & FULLWIDTH FULL STOPS SEPARATE LABELS TOO
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+
+	sLabels := strings.Split(domain, ".")
+	for ix, label := range sLabels {
+		if isASCII(label) {
+			continue
+		}
+		enc, err := punycode(strings.ToLower(label))
+		if err != nil {
+			return "", err
+		}
+		sLabels[ix] = "xn--" + enc
+	}
+	return strings.Join(sLabels, "."), nil
+}
+
+// punycode parameters, per RFC 3492 section 5.
+const (
+	pcBase        = 36
+	pcTMin        = 1
+	pcTMax        = 26
+	pcSkew        = 38
+	pcDamp        = 700
+	pcInitialBias = 72
+	pcInitialN    = 128
+	pcMaxInt      = 1<<31 - 1
+)
+
+// punycode encodes a label per RFC 3492 section 6.3.
+func punycode(label string) (string, error) {
+
+	sRunes := []rune(label)
+	var out []byte
+	for _, r := range sRunes {
+		if r < pcInitialN {
+			out = append(out, byte(r))
+		}
+	}
+	nBasic := len(out)
+	if nBasic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(pcInitialN), 0, pcInitialBias
+	for h := nBasic; h < len(sRunes); {
+
+		// NEXT CODE POINT TO INSERT
+		m := rune(pcMaxInt)
+		for _, r := range sRunes {
+			if (r >= n) && (r < m) {
+				m = r
+			}
+		}
+		if int(m-n) > (pcMaxInt-delta)/(h+1) {
+			return "", ErrSMTPUTF8Required
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range sRunes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := pcBase; ; k += pcBase {
+				t := k - bias
+				if t < pcTMin {
+					t = pcTMin
+				} else if t > pcTMax {
+					t = pcTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(pcBase-t)))
+				q = (q - t) / (pcBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, h+1, h == nBasic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punycodeAdapt is the bias adaptation function of RFC 3492 section 6.1.
+func punycodeAdapt(delta, nPoints int, bFirst bool) int {
+	if bFirst {
+		delta /= pcDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / nPoints
+	k := 0
+	for delta > ((pcBase-pcTMin)*pcTMax)/2 {
+		delta /= pcBase - pcTMin
+		k += pcBase
+	}
+	return k + (pcBase-pcTMin+1)*delta/(delta+pcSkew)
+}
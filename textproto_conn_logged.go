@@ -153,6 +153,18 @@ func (TPC loggedTextProtoConn) DotWriter() io.WriteCloser {
 	}
 }
 
+/*
+dataLogger is implemented by TextProtoConns that log message content written
+around them, rather than through DotWriter: i.e. BDAT chunks (see bdatWriter).
+*/
+type dataLogger interface {
+	logData(p []byte)
+}
+
+func (TPC loggedTextProtoConn) logData(p []byte) {
+	TPC.smtpLog.log(string(p), prefixModeSend, ansiRqBody)
+}
+
 /*
 TextprotoLogged can be used as a substitute CreateTextprotoConnFn to log the SMTP
 conversation to a specified logger.